@@ -1,6 +1,7 @@
 package main
 
 import (
+	"net"
 	"net/http"
 	"os"
 	"path"
@@ -24,8 +25,13 @@ func launchgohttpd(t *testing.T) *http.Server {
 		Addr:    ":8080",
 		Handler: http.FileServer(http.Dir(htdocs)),
 	}
+	// listen before returning, so that requests do not race the server
+	listener, err := net.Listen("tcp", s.Addr)
+	if err != nil {
+		t.Fatalf("Error listening: %v\n", err.Error())
+	}
 	t.Logf("Launching web server on http://localhost:8080/")
-	go s.ListenAndServe()
+	go s.Serve(listener)
 	return s
 }
 
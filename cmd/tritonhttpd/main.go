@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
+	"time"
 
 	"cse224/tritonhttp"
 )
@@ -22,26 +26,96 @@ func main() {
 	var port = flag.Int("port", 8080, "the localhost port to listen on")
 	var vh_config_path = flag.String("vh_config", default_vh_config_path, "path to the virtual hosting config file")
 	var docroot_dirs_path = flag.String("docroot", default_docroot, "path to the directory that contains all docroot dirs")
+	var shutdown_timeout = flag.Duration("shutdown_timeout", 10*time.Second, "how long to wait for in-flight requests on SIGINT or SIGTERM")
+	var read_header_timeout = flag.Duration("read_header_timeout", 0, "how long to wait for a request head once it starts, 0 for the server's default")
+	var read_timeout = flag.Duration("read_timeout", 0, "how long to wait for a request body, 0 for the read header timeout")
+	var write_timeout = flag.Duration("write_timeout", 0, "how long to take writing a response, 0 for no limit")
+	var idle_timeout = flag.Duration("idle_timeout", 0, "how long to keep an idle connection open, 0 for the server's default")
+	var max_requests_per_conn = flag.Int("max_requests_per_conn", 0, "the most requests to serve on one connection, 0 for no limit")
+	var reload_interval = flag.Duration("reload_interval", 0, "how often to check the virtual hosting config for changes to reload, 0 to reload on SIGHUP only")
+	var check_config = flag.Bool("check-config", false, "check the virtual hosting config and docroots, print every problem and exit")
 	flag.Parse()
 
+	virtualHosts, err := tritonhttp.LoadConfig(*vh_config_path, *docroot_dirs_path)
+	if *check_config {
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println(*vh_config_path, "is valid")
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Log server configs
 	fmt.Println()
 	log.Print("Server configs:")
 	log.Printf("  port: %v", *port)
 	log.Printf("  path to virtual hosts config file: %v", *vh_config_path)
 	log.Printf("  path to docroot directories: %v", *docroot_dirs_path)
+	log.Printf("  timeouts: read header %v, read %v, write %v, idle %v", *read_header_timeout, *read_timeout, *write_timeout, *idle_timeout)
+	log.Printf("  max requests per connection: %v", *max_requests_per_conn)
+	log.Printf("  shutdown timeout: %v", *shutdown_timeout)
+	log.Printf("  config reload interval: %v", *reload_interval)
 	fmt.Println()
 
-	virtualHosts := tritonhttp.ParseVHConfigFile(*vh_config_path, *docroot_dirs_path)
-
 	// Start server
 	addr := fmt.Sprintf(":%v", *port)
 
 	log.Printf("Starting TritonHTTP server")
 	log.Printf("You can browse the website at http://localhost:%v/", *port)
 	s := &tritonhttp.Server{
-		Addr:         addr,
-		VirtualHosts: virtualHosts,
+		Addr:               addr,
+		VirtualHosts:       virtualHosts,
+		ReadHeaderTimeout:  *read_header_timeout,
+		ReadTimeout:        *read_timeout,
+		WriteTimeout:       *write_timeout,
+		IdleTimeout:        *idle_timeout,
+		MaxRequestsPerConn: *max_requests_per_conn,
+	}
+
+	// reload the config on SIGHUP, and on changes if asked to
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			if err := s.ReloadConfig(*vh_config_path, *docroot_dirs_path); err != nil {
+				log.Printf("Keeping the current config: %v", err)
+				continue
+			}
+			log.Printf("Reloaded %v", *vh_config_path)
+		}
+	}()
+	watch_ctx, stop_watching := context.WithCancel(context.Background())
+	defer stop_watching()
+	if *reload_interval > 0 {
+		go s.WatchConfig(watch_ctx, *vh_config_path, *docroot_dirs_path, *reload_interval)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	serve_err := make(chan error, 1)
+	go func() {
+		serve_err <- s.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serve_err:
+		// the server stopped without being asked to
+		log.Fatal(err)
+	case sig := <-signals:
+		log.Printf("Received %v, shutting down", sig)
+	}
+
+	// restore the default handling, so a second signal exits at once
+	signal.Stop(signals)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdown_timeout)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown did not complete, closing remaining connections: %v", err)
+		s.Close()
 	}
-	log.Fatal(s.ListenAndServe())
+	log.Printf("TritonHTTP server stopped")
 }
@@ -3,18 +3,29 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
 	"cse224/tritonhttp"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 type ResponseChecker struct {
@@ -48,43 +59,146 @@ func findhtdocs(t *testing.T) string {
 	return htdocsdir
 }
 
-func launchhttpd(t *testing.T) {
+// launchhttpd starts the server picked by -usehttpd on a free port, which
+// it returns. The server is listening before launchhttpd returns and is
+// closed when the test ends.
+func launchhttpd(t *testing.T) string {
+	return launchhttpdin(t, "../../docroot_dirs")
+}
+
+// launchhttpdin is launchhttpd serving the doc roots of testVirtualHosts
+// out of docroot_dirs_path, e.g. a copy made by copydocroots.
+func launchhttpdin(t *testing.T, docroot_dirs_path string) string {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v\n", err.Error())
+	}
 	switch *usehttpd {
 	case "tritonhttp":
-		launchtritonhttpd(t)
+		launchtritonhttpd(t, listener, docroot_dirs_path)
 	case "go":
-		launchgohttpd(t)
+		launchgohttpd(t, listener)
 	default:
+		listener.Close()
 		t.Fatalf("Invalid server type %v (must be 'tritonhttp' or 'go')", *usehttpd)
 	}
+	return fmt.Sprint(listener.Addr().(*net.TCPAddr).Port)
 }
 
-func launchgohttpd(t *testing.T) {
+func launchgohttpd(t *testing.T, listener net.Listener) {
 	htdocs := findhtdocs(t)
 	s := &http.Server{
-		Addr:    ":8080",
 		Handler: http.FileServer(http.Dir(htdocs)),
 	}
-	go s.ListenAndServe()
+	go s.Serve(listener)
+	t.Cleanup(func() { s.Close() })
+}
+
+// testVirtualHosts configures the sites of docroot_dirs for the tests,
+// with the host matching, rules and options they exercise. The shipped
+// virtual_hosts.yaml stays a plain example.
+const testVirtualHosts = `virtual_hosts:
+  - hostName: "website1"
+    docRoot: "htdocs1"
+    aliases: ["www.website1", "*.website1"]
+    rewrites:
+      - match: "prefix"
+        from: "/latest/"
+        to: "/subdir/"
+  - hostName: "website2"
+    docRoot: "htdocs2"
+    aliases: ["*.blog.website1"]
+    symlinks: "never"
+    autoIndex: true
+    redirects:
+      - from: "/old.html"
+        to: "/index.html"
+      - match: "prefix"
+        from: "/docs/"
+        to: "http://website1/subdir/"
+        status: 308
+      - match: "regex"
+        from: "^/posts/([0-9]+)$"
+        to: "/index.html?post=$1"
+        status: 302
+    rewrites:
+      - from: "/home"
+        to: "/index.html"
+      - match: "regex"
+        from: "^/v[0-9]+/(.*)$"
+        to: "/$1"
+  - hostName: "strong"
+    docRoot: "htdocs1"
+    strongETags: true
+  - hostName: "website3"
+    docRoot: "htdocs3"
+    default: true
+    autoIndex: true
+    symlinks: "follow"
+    indexFiles: ["index.htm", "index.html"]
+    headers:
+      x-frame-options: "DENY"
+    errorPages:
+      404: "404.html"
+`
+
+// writeconfig writes config to a virtual hosts file under a temporary
+// directory and returns its path.
+func writeconfig(t *testing.T, config string) string {
+	config_path := filepath.Join(t.TempDir(), "virtual_hosts.yaml")
+	if err := os.WriteFile(config_path, []byte(config), 0644); err != nil {
+		t.Fatalf("Error writing file: %v\n", err.Error())
+	}
+	return config_path
 }
 
-func launchtritonhttpd(t *testing.T) {
+func launchtritonhttpd(t *testing.T, listener net.Listener, docroot_dirs_path string) {
 	cwd, err := os.Getwd()
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Println(cwd)
 	t.Log(cwd)
-	virtualHosts := tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs")
+	virtualHosts, err := tritonhttp.LoadConfig(writeconfig(t, testVirtualHosts), docroot_dirs_path)
+	if err != nil {
+		t.Fatalf("Error loading config: %v\n", err)
+	}
 	s := &tritonhttp.Server{
-		Addr:         ":8080",
 		VirtualHosts: virtualHosts,
 	}
-	go s.ListenAndServe()
+	go s.Serve(listener)
+	t.Cleanup(func() { s.Close() })
+}
+
+// copydocroots copies docroot_dirs into a temporary directory and returns
+// its path, for tests that add files or links to the doc roots.
+func copydocroots(t *testing.T) string {
+	dst := t.TempDir()
+	err := filepath.WalkDir("../../docroot_dirs", func(src string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel("../../docroot_dirs", src)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		}
+		contents, err := os.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dst, rel), contents, 0644)
+	})
+	if err != nil {
+		t.Fatalf("Error copying docroot_dirs: %v\n", err.Error())
+	}
+	return dst
 }
 
 func TestGoFetch1(t *testing.T) {
-	launchhttpd(t)
+	port := launchhttpd(t)
 
 	req := fmt.Sprint("GET / HTTP/1.1\r\n"+
 		"Host: website1\r\n",
@@ -92,7 +206,7 @@ func TestGoFetch1(t *testing.T) {
 		"User-Agent: gotest\r\n",
 		"\r\n")
 
-	respbytes, _, err := tritonhttp.Fetch("localhost", "8080", []byte(req))
+	respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
 	if err != nil {
 		t.Fatalf("Error fetching request: %v\n", err.Error())
 	}
@@ -117,7 +231,7 @@ func TestGoFetch1(t *testing.T) {
 }
 
 func TestGoFetch2(t *testing.T) {
-	launchhttpd(t)
+	port := launchhttpd(t)
 
 	req := fmt.Sprint("GET / HTTP/1.1\r\n",
 		"Host: website1\r\n",
@@ -130,7 +244,7 @@ func TestGoFetch2(t *testing.T) {
 		"\r\n",
 	)
 
-	respbytes, _, err := tritonhttp.Fetch("localhost", "8080", []byte(req))
+	respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
 	if err != nil {
 		t.Fatalf("Error fetching request: %v\n", err.Error())
 	}
@@ -184,7 +298,7 @@ func TestGoFetch2(t *testing.T) {
 }
 
 func TestGoFetch3(t *testing.T) {
-	launchhttpd(t)
+	port := launchhttpd(t)
 
 	req := fmt.Sprint("foobar\r\n"+
 		"Host: website1\r\n",
@@ -192,7 +306,7 @@ func TestGoFetch3(t *testing.T) {
 		"User-Agent: gotest\r\n",
 		"\r\n")
 
-	respbytes, _, err := tritonhttp.Fetch("localhost", "8080", []byte(req))
+	respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
 	if err != nil {
 		t.Fatalf("Error fetching request: %v\n", err.Error())
 	}
@@ -211,12 +325,2186 @@ func TestGoFetch3(t *testing.T) {
 	}
 }
 
-func TestAllFilesInHtdocs(t *testing.T) {
-	launchhttpd(t)
+func TestGoFetchHead(t *testing.T) {
+	port := launchhttpd(t)
+
+	req := fmt.Sprint("HEAD / HTTP/1.1\r\n",
+		"Host: website1\r\n",
+		"User-Agent: gotest\r\n",
+		"\r\n",
+		"GET / HTTP/1.1\r\n",
+		"Host: website1\r\n",
+		"User-Agent: gotest\r\n",
+		"Connection: close\r\n",
+		"\r\n",
+	)
+
+	respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+	if err != nil {
+		t.Fatalf("Error fetching request: %v\n", err.Error())
+	}
+	respreader := bufio.NewReader(bytes.NewReader(respbytes))
+
+	// response 1 has the headers of a GET but no body
+	resp, err := http.ReadResponse(respreader, &http.Request{Method: "HEAD"})
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected response code of 200 but got: %v\n", resp.StatusCode)
+	}
+
+	if resp.ContentLength != 377 {
+		t.Fatalf("Expected content length of 377 but got: %v\n", resp.ContentLength)
+	}
+
+	if resp.Header.Get("Last-Modified") == "" || resp.Header.Get("Content-Type") == "" {
+		t.Fatalf("Expected Last-Modified and Content-Type headers but got: %v\n", resp.Header)
+	}
+	resp.Body.Close()
+
+	// response 2 must start right after the headers of response 1
+	resp, err = http.ReadResponse(respreader, nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected response code of 200 but got: %v\n", resp.StatusCode)
+	}
+
+	indexbytes, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Error reading response body: %v\n", err.Error())
+	}
+
+	if len(indexbytes) != 377 {
+		t.Fatalf("Expected body of length 377 but got %v\n", len(indexbytes))
+	}
+	resp.Body.Close()
+}
+
+func TestGoFetchConditional(t *testing.T) {
+	port := launchhttpd(t)
+
+	info, err := os.Stat("../../docroot_dirs/htdocs1/UCSD_Seal.png")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	modtime := info.ModTime().UTC()
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"modified since epoch", "If-Modified-Since: Thu, 01 Jan 1970 00:00:00 GMT", 200},
+		{"not modified since mtime", "If-Modified-Since: " + tritonhttp.FormatTime(modtime), 304},
+		{"not modified rfc850", "If-Modified-Since: " + modtime.Add(time.Hour).Format(time.RFC850), 304},
+		{"not modified asctime", "If-Modified-Since: " + modtime.Add(time.Hour).Format(time.ANSIC), 304},
+		{"invalid date ignored", "If-Modified-Since: yesterday", 200},
+		{"unmodified since mtime", "If-Unmodified-Since: " + tritonhttp.FormatTime(modtime), 200},
+		{"modified after date", "If-Unmodified-Since: Thu, 01 Jan 1970 00:00:00 GMT", 412},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := fmt.Sprint("GET /UCSD_Seal.png HTTP/1.1\r\n",
+				"Host: website1\r\n",
+				tt.header+"\r\n",
+				"Connection: close\r\n",
+				"\r\n")
+
+			respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+			if err != nil {
+				t.Fatalf("Error fetching request: %v\n", err.Error())
+			}
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+			if err != nil {
+				t.Fatalf("got an error parsing the response: %v\n", err.Error())
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected response code of %v but got: %v\n", tt.status, resp.StatusCode)
+			}
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Error reading response body: %v\n", err.Error())
+			}
+			resp.Body.Close()
+
+			if tt.status != 200 && len(body) != 0 {
+				t.Fatalf("Expected an empty body but got %v bytes\n", len(body))
+			}
+		})
+	}
+}
+
+func TestGoFetchETag(t *testing.T) {
+	port := launchhttpd(t)
+
+	req := fmt.Sprint("HEAD /kitten.jpg HTTP/1.1\r\n",
+		"Host: website1\r\n",
+		"Connection: close\r\n",
+		"\r\n")
+
+	respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+	if err != nil {
+		t.Fatalf("Error fetching request: %v\n", err.Error())
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), &http.Request{Method: "HEAD"})
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal("Response did not contain an ETag header")
+	}
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"none match same tag", "If-None-Match: " + etag, 304},
+		{"none match in list", `If-None-Match: "foo", ` + etag + `, "bar"`, 304},
+		{"none match star", "If-None-Match: *", 304},
+		{"none match other tag", `If-None-Match: "foo"`, 200},
+		{"none match beats modified since", `If-None-Match: "foo"` + "\r\nIf-Modified-Since: " + resp.Header.Get("Last-Modified"), 200},
+		{"match star", "If-Match: *", 200},
+		{"match other tag", `If-Match: "foo"`, 412},
+		{"match weak tag", "If-Match: " + etag, 412},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := fmt.Sprint("GET /kitten.jpg HTTP/1.1\r\n",
+				"Host: website1\r\n",
+				tt.header+"\r\n",
+				"Connection: close\r\n",
+				"\r\n")
+
+			respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+			if err != nil {
+				t.Fatalf("Error fetching request: %v\n", err.Error())
+			}
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+			if err != nil {
+				t.Fatalf("got an error parsing the response: %v\n", err.Error())
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected response code of %v but got: %v\n", tt.status, resp.StatusCode)
+			}
+
+			if resp.StatusCode == 304 && resp.Header.Get("ETag") != etag {
+				t.Fatalf("Expected ETag %v on 304 but got %v\n", etag, resp.Header.Get("ETag"))
+			}
+		})
+	}
+
+	// the host "strong" sends strong tags, the quoted SHA-256 of the file
+	contents, err := os.ReadFile("../../docroot_dirs/htdocs1/kitten.jpg")
+	if err != nil {
+		t.Fatalf("Error reading input file: %v\n", err.Error())
+	}
+	sum := sha256.Sum256(contents)
+	strong := `"` + hex.EncodeToString(sum[:]) + `"`
+
+	strongtests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"strong tag", "User-Agent: gotest", 200},
+		{"match strong tag", "If-Match: " + strong, 200},
+		{"match weak form of strong tag", "If-Match: W/" + strong, 412},
+		{"none match strong tag", "If-None-Match: " + strong, 304},
+		{"if-range strong tag", "Range: bytes=0-9\r\nIf-Range: " + strong, 206},
+		{"if-range other tag", "Range: bytes=0-9\r\nIf-Range: \"foo\"", 200},
+	}
+
+	for _, tt := range strongtests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := fmt.Sprint("GET /kitten.jpg HTTP/1.1\r\n",
+				"Host: strong\r\n",
+				tt.header+"\r\n",
+				"Connection: close\r\n",
+				"\r\n")
+
+			respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+			if err != nil {
+				t.Fatalf("Error fetching request: %v\n", err.Error())
+			}
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+			if err != nil {
+				t.Fatalf("got an error parsing the response: %v\n", err.Error())
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected response code of %v but got: %v\n", tt.status, resp.StatusCode)
+			}
+
+			if resp.StatusCode != 412 && resp.Header.Get("ETag") != strong {
+				t.Fatalf("Expected ETag %v but got %v\n", strong, resp.Header.Get("ETag"))
+			}
+		})
+	}
+}
+
+func TestGoFetchRange(t *testing.T) {
+	port := launchhttpd(t)
+
+	origpath := "../../docroot_dirs/htdocs1/hidden/large.html"
+	origcontents, err := os.ReadFile(origpath)
+	if err != nil {
+		t.Fatalf("Error reading input file: %v\n", err.Error())
+	}
+	info, err := os.Stat(origpath)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	size := int64(len(origcontents))
+
+	tests := []struct {
+		name         string
+		header       string
+		status       int
+		contentRange string
+		body         []byte
+	}{
+		{"first bytes", "Range: bytes=0-99", 206, fmt.Sprintf("bytes 0-99/%d", size), origcontents[:100]},
+		{"suffix", "Range: bytes=-10", 206, fmt.Sprintf("bytes %d-%d/%d", size-10, size-1, size), origcontents[size-10:]},
+		{"open ended", fmt.Sprintf("Range: bytes=%d-", size-5), 206, fmt.Sprintf("bytes %d-%d/%d", size-5, size-1, size), origcontents[size-5:]},
+		{"end past eof", fmt.Sprintf("Range: bytes=10-%d", size+100), 206, fmt.Sprintf("bytes 10-%d/%d", size-1, size), origcontents[10:]},
+		{"not satisfiable", fmt.Sprintf("Range: bytes=%d-", size), 416, fmt.Sprintf("bytes */%d", size), nil},
+		{"invalid ignored", "Range: bytes=abc", 200, "", origcontents},
+		{"signed positions ignored", "Range: bytes=+0-+9", 200, "", origcontents},
+		{"other unit ignored", "Range: lines=1-2", 200, "", origcontents},
+		{"if-range date matches", "Range: bytes=0-9\r\nIf-Range: " + tritonhttp.FormatTime(info.ModTime()), 206, fmt.Sprintf("bytes 0-9/%d", size), origcontents[:10]},
+		{"if-range date stale", "Range: bytes=0-9\r\nIf-Range: Thu, 01 Jan 1970 00:00:00 GMT", 200, "", origcontents},
+		{"if-range weak etag", "Range: bytes=0-9\r\nIf-Range: W/\"foo\"", 200, "", origcontents},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := fmt.Sprint("GET /hidden/large.html HTTP/1.1\r\n",
+				"Host: website1\r\n",
+				tt.header+"\r\n",
+				"Connection: close\r\n",
+				"\r\n")
+
+			respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+			if err != nil {
+				t.Fatalf("Error fetching request: %v\n", err.Error())
+			}
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+			if err != nil {
+				t.Fatalf("got an error parsing the response: %v\n", err.Error())
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected response code of %v but got: %v\n", tt.status, resp.StatusCode)
+			}
+
+			if resp.Header.Get("Content-Range") != tt.contentRange {
+				t.Fatalf("Expected Content-Range %q but got %q\n", tt.contentRange, resp.Header.Get("Content-Range"))
+			}
+
+			if tt.status == 200 && resp.Header.Get("Accept-Ranges") != "bytes" {
+				t.Fatalf("Expected Accept-Ranges: bytes but got %q\n", resp.Header.Get("Accept-Ranges"))
+			}
+
+			respcontents, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Error reading response body: %v\n", err.Error())
+			}
+			resp.Body.Close()
+
+			if !bytes.Equal(tt.body, respcontents) {
+				t.Fatalf("Expected body of %v bytes but got %v bytes\n", len(tt.body), len(respcontents))
+			}
+		})
+	}
+}
+
+func TestGoFetchMultiRange(t *testing.T) {
+	port := launchhttpd(t)
+
+	origcontents, err := os.ReadFile("../../docroot_dirs/htdocs1/hidden/large.html")
+	if err != nil {
+		t.Fatalf("Error reading input file: %v\n", err.Error())
+	}
+	size := len(origcontents)
+
+	fetch := func(t *testing.T, rangeHeader string) *http.Response {
+		req := fmt.Sprint("GET /hidden/large.html HTTP/1.1\r\n",
+			"Host: website1\r\n",
+			"Range: "+rangeHeader+"\r\n",
+			"Connection: close\r\n",
+			"\r\n")
+
+		respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+		if err != nil {
+			t.Fatalf("Error fetching request: %v\n", err.Error())
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+		if err != nil {
+			t.Fatalf("got an error parsing the response: %v\n", err.Error())
+		}
+		return resp
+	}
+
+	t.Run("multipart", func(t *testing.T) {
+		resp := fetch(t, "bytes=0-9,20-29,25-39,-5")
+		if resp.StatusCode != 206 {
+			t.Fatalf("Expected response code of 206 but got: %v\n", resp.StatusCode)
+		}
+
+		mediatype, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if err != nil || mediatype != "multipart/byteranges" {
+			t.Fatalf("Expected a multipart/byteranges response but got %q\n", resp.Header.Get("Content-Type"))
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Error reading response body: %v\n", err.Error())
+		}
+		if int64(len(body)) != resp.ContentLength {
+			t.Fatalf("Body of %v bytes does not match Content-Length %v\n", len(body), resp.ContentLength)
+		}
+
+		want := []struct {
+			start, end int
+		}{{0, 9}, {20, 39}, {size - 5, size - 1}}
+
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for i, w := range want {
+			part, err := mr.NextPart()
+			if err != nil {
+				t.Fatalf("Error reading part %v: %v\n", i, err.Error())
+			}
+			if part.Header.Get("Content-Type") != mime.TypeByExtension(".html") {
+				t.Fatalf("Unexpected Content-Type %q in part %v\n", part.Header.Get("Content-Type"), i)
+			}
+			contentRange := fmt.Sprintf("bytes %d-%d/%d", w.start, w.end, size)
+			if part.Header.Get("Content-Range") != contentRange {
+				t.Fatalf("Expected Content-Range %q but got %q\n", contentRange, part.Header.Get("Content-Range"))
+			}
+			partcontents, err := io.ReadAll(part)
+			if err != nil {
+				t.Fatalf("Error reading part %v: %v\n", i, err.Error())
+			}
+			if !bytes.Equal(partcontents, origcontents[w.start:w.end+1]) {
+				t.Fatalf("Part %v does not match the original file\n", i)
+			}
+		}
+		if _, err := mr.NextPart(); err != io.EOF {
+			t.Fatalf("Expected exactly %v parts\n", len(want))
+		}
+	})
+
+	t.Run("coalesced into one", func(t *testing.T) {
+		resp := fetch(t, "bytes=5-19,0-9")
+		if resp.StatusCode != 206 {
+			t.Fatalf("Expected response code of 206 but got: %v\n", resp.StatusCode)
+		}
+		contentRange := fmt.Sprintf("bytes 0-19/%d", size)
+		if resp.Header.Get("Content-Range") != contentRange {
+			t.Fatalf("Expected Content-Range %q but got %q\n", contentRange, resp.Header.Get("Content-Range"))
+		}
+	})
+
+	t.Run("too many ranges", func(t *testing.T) {
+		var specs []string
+		for i := 0; i < 100; i++ {
+			specs = append(specs, fmt.Sprintf("%d-%d", i, i))
+		}
+		resp := fetch(t, "bytes="+strings.Join(specs, ","))
+		if resp.StatusCode != 416 {
+			t.Fatalf("Expected response code of 416 but got: %v\n", resp.StatusCode)
+		}
+	})
+}
+
+func TestGoFetchRequestBody(t *testing.T) {
+	port := launchhttpd(t)
+
+	// the unread body of the first request must not leak into the second
+	req := fmt.Sprint("POST /index.html HTTP/1.1\r\n",
+		"Host: website1\r\n",
+		"Content-Length: 11\r\n",
+		"\r\n",
+		"GET / HTTP/",
+		"GET / HTTP/1.1\r\n",
+		"Host: website1\r\n",
+		"Connection: close\r\n",
+		"\r\n",
+	)
+
+	respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+	if err != nil {
+		t.Fatalf("Error fetching request: %v\n", err.Error())
+	}
+	respreader := bufio.NewReader(bytes.NewReader(respbytes))
+
+	resp, err := http.ReadResponse(respreader, nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 405 {
+		t.Fatalf("Expected response code of 405 but got: %v\n", resp.StatusCode)
+	}
+
+	resp, err = http.ReadResponse(respreader, nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected response code of 200 but got: %v\n", resp.StatusCode)
+	}
+
+	// same for a chunked body with a trailer
+	req = fmt.Sprint("GET /index.html HTTP/1.1\r\n",
+		"Host: website1\r\n",
+		"Transfer-Encoding: chunked\r\n",
+		"\r\n",
+		"5;name=value\r\nhello\r\n",
+		"6\r\n world\r\n",
+		"0\r\nX-Checksum: 42\r\n\r\n",
+		"GET /subdir/ HTTP/1.1\r\n",
+		"Host: website1\r\n",
+		"Connection: close\r\n",
+		"\r\n",
+	)
+
+	respbytes, _, err = tritonhttp.Fetch("localhost", port, []byte(req))
+	if err != nil {
+		t.Fatalf("Error fetching request: %v\n", err.Error())
+	}
+	respreader = bufio.NewReader(bytes.NewReader(respbytes))
+
+	for i := 0; i < 2; i++ {
+		resp, err = http.ReadResponse(respreader, nil)
+		if err != nil {
+			t.Fatalf("got an error parsing response %v: %v\n", i, err.Error())
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != 200 {
+			t.Fatalf("Expected response code of 200 but got: %v\n", resp.StatusCode)
+		}
+	}
 
-	virtualHosts := tritonhttp.ParseVHConfigFile("../../virtual_hosts.yaml", "../../docroot_dirs")
+	// chunked bodies with lines past the limits end the connection
+	for name, body := range map[string]string{
+		"long chunk-size line": "5;ext=" + strings.Repeat("a", 5000) + "\r\nhello\r\n0\r\n\r\n",
+		"signed chunk size":    "+5\r\nhello\r\n0\r\n\r\n",
+		"long trailer field":   "0\r\nX-Checksum: " + strings.Repeat("4", 9000) + "\r\n\r\n",
+		"many trailer fields":  "0\r\n" + strings.Repeat("X-Checksum: 42\r\n", 101) + "\r\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			req := fmt.Sprint("GET /index.html HTTP/1.1\r\n",
+				"Host: website1\r\n",
+				"Transfer-Encoding: chunked\r\n",
+				"\r\n",
+				body,
+				"GET / HTTP/1.1\r\n",
+				"Host: website1\r\n",
+				"Connection: close\r\n",
+				"\r\n",
+			)
 
-	for hostname, docRoot := range virtualHosts {
+			respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+			if err != nil {
+				t.Fatalf("Error fetching request: %v\n", err.Error())
+			}
+			respreader := bufio.NewReader(bytes.NewReader(respbytes))
+
+			resp, err := http.ReadResponse(respreader, nil)
+			if err != nil {
+				t.Fatalf("got an error parsing the response: %v\n", err.Error())
+			}
+			resp.Body.Close()
+
+			if _, err := http.ReadResponse(respreader, nil); err == nil {
+				t.Fatal("Expected the connection to be closed after the malformed body")
+			}
+		})
+	}
+
+	tests := []struct {
+		name   string
+		req    string
+		status int
+	}{
+		{"missing length", "POST / HTTP/1.1\r\nHost: website1\r\n\r\n", 411},
+		{"invalid length", "PUT / HTTP/1.1\r\nHost: website1\r\nContent-Length: -1\r\n\r\n", 400},
+		{"signed length", "PUT / HTTP/1.1\r\nHost: website1\r\nContent-Length: +3\r\n\r\nabc", 400},
+		{"oversized length", "PUT / HTTP/1.1\r\nHost: website1\r\nContent-Length: 1099511627776\r\n\r\n", 413},
+		{"unsupported coding", "POST / HTTP/1.1\r\nHost: website1\r\nTransfer-Encoding: gzip\r\n\r\n", 501},
+		{"coding and length", "POST / HTTP/1.1\r\nHost: website1\r\nTransfer-Encoding: chunked\r\nContent-Length: 3\r\n\r\n", 400},
+		// the response must survive the body the server leaves unread
+		{"missing length with body", "POST / HTTP/1.1\r\nHost: website1\r\n\r\n" + strings.Repeat("a", 128<<10), 411},
+		{"oversized length with body", "PUT / HTTP/1.1\r\nHost: website1\r\nContent-Length: 1099511627776\r\n\r\n" + strings.Repeat("a", 128<<10), 413},
+		{"unsupported coding with body", "POST / HTTP/1.1\r\nHost: website1\r\nTransfer-Encoding: gzip\r\n\r\n" + strings.Repeat("a", 128<<10), 501},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(tt.req))
+			if err != nil {
+				t.Fatalf("Error fetching request: %v\n", err.Error())
+			}
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+			if err != nil {
+				t.Fatalf("got an error parsing the response: %v\n", err.Error())
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected response code of %v but got: %v\n", tt.status, resp.StatusCode)
+			}
+
+			if !resp.Close {
+				t.Fatal("Expected the connection to be closed")
+			}
+		})
+	}
+}
+
+func TestGoFetchCompression(t *testing.T) {
+	port := launchhttpd(t)
+
+	origcontents, err := os.ReadFile("../../docroot_dirs/htdocs1/hidden/large.html")
+	if err != nil {
+		t.Fatalf("Error reading input file: %v\n", err.Error())
+	}
+
+	tests := []struct {
+		name     string
+		url      string
+		header   string
+		encoding string
+		vary     bool
+	}{
+		{"gzip", "/hidden/large.html", "Accept-Encoding: gzip, deflate", "gzip", true},
+		{"deflate preferred", "/hidden/large.html", "Accept-Encoding: gzip;q=0.5, deflate", "deflate", true},
+		{"gzip refused", "/hidden/large.html", "Accept-Encoding: gzip;q=0, *;q=0.3", "deflate", true},
+		{"identity preferred", "/hidden/large.html", "Accept-Encoding: identity, gzip;q=0.5", "", true},
+		{"unsupported coding", "/hidden/large.html", "Accept-Encoding: br", "", true},
+		{"no accept-encoding", "/hidden/large.html", "User-Agent: gotest", "", true},
+		{"range request", "/hidden/large.html", "Accept-Encoding: gzip\r\nRange: bytes=0-99", "", true},
+		{"small file", "/index.html", "Accept-Encoding: gzip", "", false},
+		{"not text", "/UCSD_Seal.png", "Accept-Encoding: gzip", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := fmt.Sprint("GET "+tt.url+" HTTP/1.1\r\n",
+				"Host: website1\r\n",
+				tt.header+"\r\n",
+				"Connection: close\r\n",
+				"\r\n")
+
+			respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+			if err != nil {
+				t.Fatalf("Error fetching request: %v\n", err.Error())
+			}
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+			if err != nil {
+				t.Fatalf("got an error parsing the response: %v\n", err.Error())
+			}
+			defer resp.Body.Close()
+
+			if resp.Header.Get("Content-Encoding") != tt.encoding {
+				t.Fatalf("Expected Content-Encoding %q but got %q\n", tt.encoding, resp.Header.Get("Content-Encoding"))
+			}
+
+			if (resp.Header.Get("Vary") == "Accept-Encoding") != tt.vary {
+				t.Fatalf("Unexpected Vary header %q\n", resp.Header.Get("Vary"))
+			}
+
+			if (resp.Header.Get("Accept-Ranges") == "bytes") != (tt.encoding == "") {
+				t.Fatalf("Expected Accept-Ranges only without on-the-fly compression but got %q\n", resp.Header.Get("Accept-Ranges"))
+			}
+
+			if tt.encoding == "" {
+				return
+			}
+
+			if resp.Header.Get("Content-Type") != mime.TypeByExtension(".html") {
+				t.Fatalf("Unexpected Content-Type %q\n", resp.Header.Get("Content-Type"))
+			}
+
+			var decoder io.Reader
+			if tt.encoding == "gzip" {
+				decoder, err = gzip.NewReader(resp.Body)
+			} else {
+				decoder, err = zlib.NewReader(resp.Body)
+			}
+			if err != nil {
+				t.Fatalf("Error decoding response body: %v\n", err.Error())
+			}
+
+			respcontents, err := io.ReadAll(decoder)
+			if err != nil {
+				t.Fatalf("Error decoding response body: %v\n", err.Error())
+			}
+
+			if !bytes.Equal(origcontents, respcontents) {
+				t.Fatal("Decoded response body does not equal original file contents")
+			}
+		})
+	}
+}
+
+func TestGoFetchPrecompressed(t *testing.T) {
+	docroot := copydocroots(t)
+	port := launchhttpdin(t, docroot)
+
+	origpath := filepath.Join(docroot, "htdocs2", "index.html")
+	origcontents, err := os.ReadFile(origpath)
+	if err != nil {
+		t.Fatalf("Error reading input file: %v\n", err.Error())
+	}
+
+	// write a precompressed sibling
+	var gzcontents bytes.Buffer
+	gw := gzip.NewWriter(&gzcontents)
+	gw.Write(origcontents)
+	gw.Close()
+	if err := os.WriteFile(origpath+".gz", gzcontents.Bytes(), 0644); err != nil {
+		t.Fatalf("Error writing precompressed file: %v\n", err.Error())
+	}
+
+	tests := []struct {
+		name     string
+		header   string
+		encoding string
+	}{
+		{"gzip accepted", "Accept-Encoding: br;q=0.9, gzip", "gzip"},
+		{"gzip refused", "Accept-Encoding: gzip;q=0", ""},
+		{"no accept-encoding", "User-Agent: gotest", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := fmt.Sprint("GET /index.html HTTP/1.1\r\n",
+				"Host: website2\r\n",
+				tt.header+"\r\n",
+				"Connection: close\r\n",
+				"\r\n")
+
+			respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+			if err != nil {
+				t.Fatalf("Error fetching request: %v\n", err.Error())
+			}
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+			if err != nil {
+				t.Fatalf("got an error parsing the response: %v\n", err.Error())
+			}
+
+			if resp.Header.Get("Content-Encoding") != tt.encoding {
+				t.Fatalf("Expected Content-Encoding %q but got %q\n", tt.encoding, resp.Header.Get("Content-Encoding"))
+			}
+
+			if resp.Header.Get("Content-Type") != mime.TypeByExtension(".html") {
+				t.Fatalf("Unexpected Content-Type %q\n", resp.Header.Get("Content-Type"))
+			}
+
+			if resp.Header.Get("Vary") != "Accept-Encoding" {
+				t.Fatalf("Expected Vary: Accept-Encoding but got %q\n", resp.Header.Get("Vary"))
+			}
+
+			want := origcontents
+			if tt.encoding == "gzip" {
+				want = gzcontents.Bytes()
+			}
+
+			if resp.ContentLength != int64(len(want)) {
+				t.Fatalf("Expected Content-Length of %v but got %v\n", len(want), resp.ContentLength)
+			}
+
+			respcontents, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Error reading response body: %v\n", err.Error())
+			}
+			resp.Body.Close()
+
+			if !bytes.Equal(want, respcontents) {
+				t.Fatal("Response body does not equal the expected file contents")
+			}
+		})
+	}
+}
+
+func TestGoFetchAutoIndex(t *testing.T) {
+	docroot := copydocroots(t)
+	port := launchhttpdin(t, docroot)
+
+	// website3 has autoIndex enabled; website1 does not
+	for _, host := range []string{"htdocs1", "htdocs3"} {
+		dir := filepath.Join(docroot, host, "listing")
+		if err := os.MkdirAll(filepath.Join(dir, "subdir"), 0755); err != nil {
+			t.Fatalf("Error creating directory: %v\n", err.Error())
+		}
+		for name, contents := range map[string]string{"a.txt": "aaaa", "b.txt": "b", ".secret": "hidden"} {
+			if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+				t.Fatalf("Error writing file: %v\n", err.Error())
+			}
+		}
+	}
+
+	fetch := func(t *testing.T, host string, url string, header string) *http.Response {
+		req := fmt.Sprint("GET "+url+" HTTP/1.1\r\n",
+			"Host: "+host+"\r\n",
+			header+"\r\n",
+			"Connection: close\r\n",
+			"\r\n")
+
+		respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+		if err != nil {
+			t.Fatalf("Error fetching request: %v\n", err.Error())
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+		if err != nil {
+			t.Fatalf("got an error parsing the response: %v\n", err.Error())
+		}
+		return resp
+	}
+
+	t.Run("disabled", func(t *testing.T) {
+		resp := fetch(t, "website1", "/listing/", "User-Agent: gotest")
+		if resp.StatusCode != 404 {
+			t.Fatalf("Expected response code of 404 but got: %v\n", resp.StatusCode)
+		}
+	})
+
+	t.Run("html", func(t *testing.T) {
+		resp := fetch(t, "website3", "/listing/", "User-Agent: gotest")
+		if resp.StatusCode != 200 {
+			t.Fatalf("Expected response code of 200 but got: %v\n", resp.StatusCode)
+		}
+		if resp.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+			t.Fatalf("Unexpected Content-Type %q\n", resp.Header.Get("Content-Type"))
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Error reading response body: %v\n", err.Error())
+		}
+		for _, want := range []string{`href="a.txt"`, `href="b.txt"`, `href="subdir/"`, `href="../"`} {
+			if !strings.Contains(string(body), want) {
+				t.Fatalf("Expected the listing to contain %s\n", want)
+			}
+		}
+		if strings.Contains(string(body), ".secret") {
+			t.Fatal("Listing shows a hidden file")
+		}
+	})
+
+	tests := []struct {
+		name  string
+		url   string
+		names []string
+	}{
+		{"json", "/listing/", []string{"subdir", "a.txt", "b.txt"}},
+		{"sort by size", "/listing/?sort=size", []string{"subdir", "b.txt", "a.txt"}},
+		{"sort descending", "/listing/?sort=name&order=desc", []string{"subdir", "b.txt", "a.txt"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := fetch(t, "website3", tt.url, "Accept: application/json")
+			if resp.StatusCode != 200 {
+				t.Fatalf("Expected response code of 200 but got: %v\n", resp.StatusCode)
+			}
+			if resp.Header.Get("Content-Type") != "application/json" {
+				t.Fatalf("Unexpected Content-Type %q\n", resp.Header.Get("Content-Type"))
+			}
+
+			var entries []struct {
+				Name  string `json:"name"`
+				Size  int64  `json:"size"`
+				IsDir bool   `json:"isDir"`
+			}
+			if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+				t.Fatalf("Error decoding listing: %v\n", err.Error())
+			}
+			var names []string
+			for _, entry := range entries {
+				names = append(names, entry.Name)
+			}
+			if strings.Join(names, ",") != strings.Join(tt.names, ",") {
+				t.Fatalf("Expected entries %v but got %v\n", tt.names, names)
+			}
+		})
+	}
+}
+
+func TestGoFetchDirectoryRedirect(t *testing.T) {
+	port := launchhttpd(t)
+
+	tests := []struct {
+		name     string
+		url      string
+		status   int
+		location string
+	}{
+		{"directory", "/subdir", 301, "/subdir/"},
+		{"nested directory", "/subdir/subsubdir", 301, "/subdir/subsubdir/"},
+		{"query string", "/subdir?a=1&b=2", 301, "/subdir/?a=1&b=2"},
+		{"double slash", "//subdir", 301, "/subdir/"},
+		{"trailing slash", "/subdir/", 200, ""},
+		{"file", "/index.html", 200, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := fmt.Sprint("GET "+tt.url+" HTTP/1.1\r\n",
+				"Host: website1\r\n",
+				"Connection: close\r\n",
+				"\r\n")
+
+			respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+			if err != nil {
+				t.Fatalf("Error fetching request: %v\n", err.Error())
+			}
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+			if err != nil {
+				t.Fatalf("got an error parsing the response: %v\n", err.Error())
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected response code of %v but got: %v\n", tt.status, resp.StatusCode)
+			}
+
+			if resp.Header.Get("Location") != tt.location {
+				t.Fatalf("Expected Location %q but got %q\n", tt.location, resp.Header.Get("Location"))
+			}
+		})
+	}
+}
+
+func TestGoFetchRules(t *testing.T) {
+	port := launchhttpd(t)
+
+	tests := []struct {
+		name     string
+		host     string
+		method   string
+		url      string
+		status   int
+		location string
+	}{
+		{"exact redirect", "website2", "GET", "/old.html", 301, "/index.html"},
+		{"exact redirect keeps query", "website2", "GET", "/old.html?a=1", 301, "/index.html?a=1"},
+		{"prefix redirect", "website2", "GET", "/docs/a/b.html", 308, "http://website1/subdir/a/b.html"},
+		{"prefix redirect for post", "website2", "POST", "/docs/", 308, "http://website1/subdir/"},
+		{"regex redirect", "website2", "GET", "/posts/42?x=y", 302, "/index.html?post=42&x=y"},
+		{"regex redirect no match", "website2", "GET", "/posts/abc", 404, ""},
+		{"exact rewrite", "website2", "GET", "/home", 200, ""},
+		{"regex rewrite", "website2", "GET", "/v2/index.html", 200, ""},
+		{"rewrite still contained", "website2", "GET", "/v2/../../htdocs1/index.html", 404, ""},
+		{"rewrite to a directory", "website1", "GET", "/latest/subsubdir?a=1", 301, "/latest/subsubdir/?a=1"},
+		{"rewrite to a directory index", "website1", "GET", "/latest/subsubdir/", 200, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := fmt.Sprint(tt.method+" "+tt.url+" HTTP/1.1\r\n",
+				"Host: "+tt.host+"\r\n",
+				"Content-Length: 0\r\n",
+				"Connection: close\r\n",
+				"\r\n")
+
+			respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+			if err != nil {
+				t.Fatalf("Error fetching request: %v\n", err.Error())
+			}
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+			if err != nil {
+				t.Fatalf("got an error parsing the response: %v\n", err.Error())
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected response code of %v but got: %v\n", tt.status, resp.StatusCode)
+			}
+
+			if resp.Header.Get("Location") != tt.location {
+				t.Fatalf("Expected Location %q but got %q\n", tt.location, resp.Header.Get("Location"))
+			}
+		})
+	}
+}
+
+func TestGoFetchVirtualHostConfig(t *testing.T) {
+	docroot := copydocroots(t)
+	port := launchhttpdin(t, docroot)
+
+	// the errorPages of website3 send 404.html with a 404
+	errorpage := "<html><body><h1>Not found on website 3</h1></body></html>\n"
+	if err := os.WriteFile(filepath.Join(docroot, "htdocs3", "404.html"), []byte(errorpage), 0644); err != nil {
+		t.Fatalf("Error writing file: %v\n", err.Error())
+	}
+
+	// index.htm comes before index.html in the indexFiles of website3
+	dir := filepath.Join(docroot, "htdocs3", "indexed")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Error creating directory: %v\n", err.Error())
+	}
+	for name, contents := range map[string]string{"index.htm": "htm", "index.html": "html"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("Error writing file: %v\n", err.Error())
+		}
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		status int
+		body   string
+	}{
+		{"error page", "GET", "/missing.html", 404, errorpage},
+		{"error page for head", "HEAD", "/missing.html", 404, ""},
+		{"index file order", "GET", "/indexed/", 200, "htm"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := fmt.Sprint(tt.method+" "+tt.url+" HTTP/1.1\r\n",
+				"Host: website3\r\n",
+				"Connection: close\r\n",
+				"\r\n")
+
+			respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+			if err != nil {
+				t.Fatalf("Error fetching request: %v\n", err.Error())
+			}
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), &http.Request{Method: tt.method})
+			if err != nil {
+				t.Fatalf("got an error parsing the response: %v\n", err.Error())
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected response code of %v but got: %v\n", tt.status, resp.StatusCode)
+			}
+
+			if resp.Header.Get("X-Frame-Options") != "DENY" {
+				t.Fatalf("Expected the custom header but got %q\n", resp.Header.Get("X-Frame-Options"))
+			}
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Error reading response body: %v\n", err.Error())
+			}
+			if string(body) != tt.body {
+				t.Fatalf("Expected body %q but got %q\n", tt.body, body)
+			}
+		})
+	}
+}
+
+func TestGoFetchHostMatching(t *testing.T) {
+	port := launchhttpd(t)
+
+	tests := []struct {
+		name   string
+		host   string
+		htdocs string
+	}{
+		{"exact", "website1", "htdocs1"},
+		{"alias", "www.website1", "htdocs1"},
+		{"wildcard", "a.website1", "htdocs1"},
+		{"nested wildcard", "a.b.website1", "htdocs1"},
+		{"longer wildcard wins", "a.blog.website1", "htdocs2"},
+		{"wildcard needs a subdomain", "blog.website1", "htdocs1"},
+		{"default", "unknown", "htdocs3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := fmt.Sprint("GET /index.html HTTP/1.1\r\n",
+				"Host: "+tt.host+"\r\n",
+				"Connection: close\r\n",
+				"\r\n")
+
+			respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+			if err != nil {
+				t.Fatalf("Error fetching request: %v\n", err.Error())
+			}
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+			if err != nil {
+				t.Fatalf("got an error parsing the response: %v\n", err.Error())
+			}
+
+			if resp.StatusCode != 200 {
+				t.Fatalf("Expected response code of 200 but got: %v\n", resp.StatusCode)
+			}
+
+			want, err := os.ReadFile("../../docroot_dirs/" + tt.htdocs + "/index.html")
+			if err != nil {
+				t.Fatalf("Error reading input file: %v\n", err.Error())
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Error reading response body: %v\n", err.Error())
+			}
+			if !bytes.Equal(want, body) {
+				t.Fatalf("Expected the index of %v\n", tt.htdocs)
+			}
+		})
+	}
+}
+
+func TestGoFetchHostNormalization(t *testing.T) {
+	port := launchhttpd(t)
+
+	tests := []struct {
+		name   string
+		target string
+		host   string
+		status int
+		htdocs string
+	}{
+		{"port", "/index.html", "website1:8080", 200, "htdocs1"},
+		{"empty port", "/index.html", "website1:", 200, "htdocs1"},
+		{"upper case", "/index.html", "WebSite2", 200, "htdocs2"},
+		{"trailing dot", "/index.html", "website2.", 200, "htdocs2"},
+		{"ipv6 literal", "/index.html", "[::1]:8080", 200, "htdocs3"},
+		{"absolute-form", "http://website2:8080/index.html", "website1", 200, "htdocs2"},
+		{"absolute-form without path", "HTTP://Website2", "website1", 200, "htdocs2"},
+		{"invalid port", "/index.html", "website1:http", 400, ""},
+		{"port out of range", "/index.html", "website1:65536", 400, ""},
+		{"unbracketed ipv6", "/index.html", "::1", 400, ""},
+		{"bracketed ipv4", "/index.html", "[127.0.0.1]", 400, ""},
+		{"invalid character", "/index.html", "web/site1", 400, ""},
+		{"duplicate host", "/index.html", "website1\r\nHost: website2", 400, ""},
+		{"user info", "http://user@website1/index.html", "website1", 400, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := fmt.Sprint("GET "+tt.target+" HTTP/1.1\r\n",
+				"Host: "+tt.host+"\r\n",
+				"Connection: close\r\n",
+				"\r\n")
+
+			respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+			if err != nil {
+				t.Fatalf("Error fetching request: %v\n", err.Error())
+			}
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+			if err != nil {
+				t.Fatalf("got an error parsing the response: %v\n", err.Error())
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected response code of %v but got: %v\n", tt.status, resp.StatusCode)
+			}
+			if tt.htdocs == "" {
+				return
+			}
+
+			want, err := os.ReadFile("../../docroot_dirs/" + tt.htdocs + "/index.html")
+			if err != nil {
+				t.Fatalf("Error reading input file: %v\n", err.Error())
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Error reading response body: %v\n", err.Error())
+			}
+			if !bytes.Equal(want, body) {
+				t.Fatalf("Expected the index of %v\n", tt.htdocs)
+			}
+		})
+	}
+}
+
+func TestGoFetchParser(t *testing.T) {
+	port := launchhttpd(t)
+
+	tests := []struct {
+		name   string
+		req    string
+		status int
+		close  bool
+	}{
+		{"colon in value", "GET /index.html HTTP/1.1\r\nHost: website1\r\nReferer: http://website1:8080/\r\nConnection: close\r\n\r\n", 200, true},
+		{"tab around value", "GET /index.html HTTP/1.1\r\nHost:\twebsite1\t\r\nConnection: close\r\n\r\n", 200, true},
+		{"close in connection list", "GET /index.html HTTP/1.1\r\nHost: website1\r\nConnection: keep-alive, Close\r\n\r\n", 200, true},
+		{"unknown method", "BREW /index.html HTTP/1.1\r\nHost: website1\r\n\r\n", 501, true},
+		{"unsupported version", "GET /index.html HTTP/2.0\r\nHost: website1\r\n\r\n", 505, true},
+		{"malformed version", "GET /index.html HTTP/1\r\nHost: website1\r\n\r\n", 400, true},
+		{"extra space", "GET  /index.html HTTP/1.1\r\nHost: website1\r\n\r\n", 400, true},
+		{"invalid method", "G(T /index.html HTTP/1.1\r\nHost: website1\r\n\r\n", 400, true},
+		{"asterisk target", "GET * HTTP/1.1\r\nHost: website1\r\n\r\n", 400, true},
+		{"space before colon", "GET /index.html HTTP/1.1\r\nHost : website1\r\n\r\n", 400, true},
+		{"non-token name", "GET /index.html HTTP/1.1\r\nHost: website1\r\nX[1]: a\r\n\r\n", 400, true},
+		{"control character", "GET /index.html HTTP/1.1\r\nHost: website1\r\nX-A: a\x01b\r\n\r\n", 400, true},
+		{"obs-fold", "GET /index.html HTTP/1.1\r\nHost: website1\r\nX-A: a\r\n b\r\n\r\n", 400, true},
+		{"bare LF", "GET /index.html HTTP/1.1\nHost: website1\r\n\r\n", 400, true},
+		{"missing host", "GET /index.html HTTP/1.1\r\nUser-Agent: gotest\r\n\r\n", 400, true},
+		{"conflicting lengths", "POST / HTTP/1.1\r\nHost: website1\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\nab", 400, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(tt.req))
+			if err != nil {
+				t.Fatalf("Error fetching request: %v\n", err.Error())
+			}
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+			if err != nil {
+				t.Fatalf("got an error parsing the response: %v\n", err.Error())
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected response code of %v but got: %v\n", tt.status, resp.StatusCode)
+			}
+
+			if resp.Close != tt.close {
+				t.Fatalf("Expected Close to be %v\n", tt.close)
+			}
+		})
+	}
+}
+
+func TestGoFetchRepeatedHeader(t *testing.T) {
+	port := launchhttpd(t)
+
+	// the codings of both fields count, as if sent as "identity;q=0.5, gzip"
+	req := fmt.Sprint("GET /hidden/large.html HTTP/1.1\r\n",
+		"Host: website1\r\n",
+		"Accept-Encoding: identity;q=0.5\r\n",
+		"Accept-Encoding: gzip\r\n",
+		"Connection: close\r\n",
+		"\r\n")
+
+	respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+	if err != nil {
+		t.Fatalf("Error fetching request: %v\n", err.Error())
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected Content-Encoding gzip but got %q\n", resp.Header.Get("Content-Encoding"))
+	}
+}
+
+func TestGoFetchHeadLimits(t *testing.T) {
+	port := launchhttpd(t)
+
+	manyHeaders := ""
+	for i := 0; i < 101; i++ {
+		manyHeaders += fmt.Sprintf("X-Header-%d: %d\r\n", i, i)
+	}
+	bigHeaders := ""
+	for i := 0; i < 20; i++ {
+		bigHeaders += fmt.Sprintf("X-Header-%d: %s\r\n", i, strings.Repeat("a", 4000))
+	}
+
+	tests := []struct {
+		name    string
+		target  string
+		headers string
+		status  int
+	}{
+		{"long request line", "/" + strings.Repeat("a", 9000), "", 414},
+		{"long header", "/index.html", "X-Long: " + strings.Repeat("a", 9000) + "\r\n", 431},
+		{"header within limit", "/index.html", "X-Long: " + strings.Repeat("a", 8000) + "\r\n", 200},
+		{"too many headers", "/index.html", manyHeaders, 431},
+		{"header section too large", "/index.html", bigHeaders, 431},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := fmt.Sprint("GET "+tt.target+" HTTP/1.1\r\n",
+				"Host: website1\r\n",
+				tt.headers,
+				"Connection: close\r\n",
+				"\r\n")
+
+			respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+			if err != nil {
+				t.Fatalf("Error fetching request: %v\n", err.Error())
+			}
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+			if err != nil {
+				t.Fatalf("got an error parsing the response: %v\n", err.Error())
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected response code of %v but got: %v\n", tt.status, resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestGoFetchEncodedURL(t *testing.T) {
+	docroot := copydocroots(t)
+	port := launchhttpdin(t, docroot)
+
+	dir := filepath.Join(docroot, "htdocs1", "my dir")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatalf("Error creating directory: %v\n", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(dir, "my file.html"), []byte("spaces"), 0644); err != nil {
+		t.Fatalf("Error writing file: %v\n", err.Error())
+	}
+
+	tests := []struct {
+		name     string
+		target   string
+		status   int
+		location string
+	}{
+		{"encoded spaces", "/my%20dir/my%20file.html", 200, ""},
+		{"query string", "/my%20dir/my%20file.html?v=3&x", 200, ""},
+		{"encoded slash", "/my%20dir%2Fmy%20file.html", 200, ""},
+		{"encoded directory redirect", "/my%20dir?a=b", 301, "/my%20dir/?a=b"},
+		{"encoded traversal", "/%2e%2e/htdocs2/index.html", 404, ""},
+		{"encoded traversal past root", "/%2E%2E/%2e%2e/%2e%2e/%2e%2e/etc/passwd", 404, ""},
+		{"fragment", "/index.html#top", 400, ""},
+		{"invalid escape", "/index%zz.html", 400, ""},
+		{"encoded NUL", "/index.html%00.png", 400, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := fmt.Sprint("GET "+tt.target+" HTTP/1.1\r\n",
+				"Host: website1\r\n",
+				"Connection: close\r\n",
+				"\r\n")
+
+			respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+			if err != nil {
+				t.Fatalf("Error fetching request: %v\n", err.Error())
+			}
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+			if err != nil {
+				t.Fatalf("got an error parsing the response: %v\n", err.Error())
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected response code of %v but got: %v\n", tt.status, resp.StatusCode)
+			}
+
+			if resp.Header.Get("Location") != tt.location {
+				t.Fatalf("Expected Location %q but got %q\n", tt.location, resp.Header.Get("Location"))
+			}
+
+			if tt.status == 200 {
+				body, err := io.ReadAll(resp.Body)
+				if err != nil {
+					t.Fatalf("Error reading response body: %v\n", err.Error())
+				}
+				if string(body) != "spaces" {
+					t.Fatalf("Expected the contents of my file.html but got %q\n", body)
+				}
+			}
+		})
+	}
+}
+
+func TestGoFetchSymlinks(t *testing.T) {
+	docroot := copydocroots(t)
+	port := launchhttpdin(t, docroot)
+
+	// htdocs10 shares its prefix with htdocs1 but is not below it
+	outside := filepath.Join(docroot, "htdocs10")
+	if err := os.MkdirAll(filepath.Join(outside, "dir"), 0755); err != nil {
+		t.Fatalf("Error creating directory: %v\n", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(outside, "secret.html"), []byte("secret"), 0644); err != nil {
+		t.Fatalf("Error writing file: %v\n", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(outside, "dir", "index.html"), []byte("secret"), 0644); err != nil {
+		t.Fatalf("Error writing file: %v\n", err.Error())
+	}
+
+	links := map[string]string{
+		"htdocs1/inside.html":       "index.html",
+		"htdocs1/inside-dir":        "subdir",
+		"htdocs1/outside.html":      "../htdocs10/secret.html",
+		"htdocs1/outside-dir":       "../htdocs10/dir",
+		"htdocs1/sibling.html":      "../htdocs2/index.html",
+		"htdocs1/dangling.html":     "missing.html",
+		"htdocs1/index.html.gz":     "../htdocs10/secret.html",
+		"htdocs2/inside.html":       "index.html",
+		"htdocs2/listing/link.html": "../index.html",
+		"htdocs3/outside.html":      "../htdocs10/secret.html",
+		"htdocs3/outside-dir":       "../htdocs10/dir",
+		"htdocs3/outside-listing":   "../htdocs10",
+	}
+	if err := os.MkdirAll(filepath.Join(docroot, "htdocs2", "listing"), 0755); err != nil {
+		t.Fatalf("Error creating directory: %v\n", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(docroot, "htdocs2", "listing", "plain.html"), []byte("plain"), 0644); err != nil {
+		t.Fatalf("Error writing file: %v\n", err.Error())
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(docroot, name)); err != nil {
+			t.Fatalf("Error creating symlink: %v\n", err.Error())
+		}
+	}
+
+	tests := []struct {
+		name   string
+		host   string
+		target string
+		status int
+	}{
+		{"parent segments", "website1", "/../htdocs2/index.html", 404},
+		{"parent segments below a directory", "website1", "/subdir/../../htdocs2/index.html", 404},
+		{"encoded parent segments", "website1", "/%2e%2e/%2e%2e/htdocs10/secret.html", 404},
+		{"encoded slashes", "website1", "/..%2f..%2fhtdocs10%2fsecret.html", 404},
+		{"backslashes", "website1", "/..\\htdocs10\\secret.html", 404},
+		{"link inside docroot", "website1", "/inside.html", 200},
+		{"link to directory inside docroot", "website1", "/inside-dir/", 200},
+		{"link out of docroot", "website1", "/outside.html", 404},
+		{"link to directory out of docroot", "website1", "/outside-dir/", 404},
+		{"link to docroot with shared prefix", "website1", "/outside-dir/index.html", 404},
+		{"link to other docroot", "website1", "/sibling.html", 404},
+		{"dangling link", "website1", "/dangling.html", 404},
+		{"never follows links", "website2", "/inside.html", 404},
+		{"never still serves files", "website2", "/index.html", 200},
+		{"follow leaves docroot", "website3", "/outside.html", 200},
+		{"follow directory out of docroot", "website3", "/outside-dir/", 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := fmt.Sprint("GET "+tt.target+" HTTP/1.1\r\n",
+				"Host: "+tt.host+"\r\n",
+				"Connection: close\r\n",
+				"\r\n")
+
+			respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+			if err != nil {
+				t.Fatalf("Error fetching request: %v\n", err.Error())
+			}
+
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+			if err != nil {
+				t.Fatalf("got an error parsing the response: %v\n", err.Error())
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected response code of %v but got: %v\n", tt.status, resp.StatusCode)
+			}
+
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Error reading response body: %v\n", err.Error())
+			}
+			if tt.status != 200 && strings.Contains(string(body), "secret") {
+				t.Fatalf("Response leaked a file out of the docroot: %q\n", body)
+			}
+		})
+	}
+
+	t.Run("precompressed link out of docroot", func(t *testing.T) {
+		req := "GET /index.html HTTP/1.1\r\nHost: website1\r\nAccept-Encoding: gzip\r\nConnection: close\r\n\r\n"
+
+		respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+		if err != nil {
+			t.Fatalf("Error fetching request: %v\n", err.Error())
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+		if err != nil {
+			t.Fatalf("got an error parsing the response: %v\n", err.Error())
+		}
+
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Error reading response body: %v\n", err.Error())
+		}
+		if strings.Contains(string(body), "secret") {
+			t.Fatalf("Response leaked a file out of the docroot: %q\n", body)
+		}
+	})
+
+	t.Run("listing through followed link", func(t *testing.T) {
+		req := "GET /outside-listing/ HTTP/1.1\r\nHost: website3\r\nConnection: close\r\n\r\n"
+
+		respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+		if err != nil {
+			t.Fatalf("Error fetching request: %v\n", err.Error())
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+		if err != nil {
+			t.Fatalf("got an error parsing the response: %v\n", err.Error())
+		}
+
+		if resp.StatusCode != 200 {
+			t.Fatalf("Expected response code of 200 but got: %v\n", resp.StatusCode)
+		}
+	})
+
+	t.Run("listing leaves out refused links", func(t *testing.T) {
+		req := "GET /listing/ HTTP/1.1\r\nHost: website2\r\nAccept: application/json\r\nConnection: close\r\n\r\n"
+
+		respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+		if err != nil {
+			t.Fatalf("Error fetching request: %v\n", err.Error())
+		}
+
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+		if err != nil {
+			t.Fatalf("got an error parsing the response: %v\n", err.Error())
+		}
+
+		var entries []struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+			t.Fatalf("Error decoding listing: %v\n", err.Error())
+		}
+		if len(entries) != 1 || entries[0].Name != "plain.html" {
+			t.Fatalf("Expected only plain.html to be listed but got %v\n", entries)
+		}
+	})
+}
+
+// launchblockingserver starts a server on a free port whose handler
+// answers "/slow" only once release is closed, after closing started. It
+// returns the server, its address and a channel receiving the result of
+// Serve.
+func launchblockingserver(t *testing.T, started chan struct{}, release chan struct{}) (*tritonhttp.Server, string, chan error) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v\n", err.Error())
+	}
+	s := &tritonhttp.Server{
+		Handler: tritonhttp.HandlerFunc(func(w tritonhttp.ResponseWriter, req *tritonhttp.Request) {
+			if req.Path == "/slow" {
+				close(started)
+				<-release
+			}
+			w.Write([]byte("done"))
+		}),
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(listener)
+	}()
+	return s, listener.Addr().String(), served
+}
+
+// dialserver connects to addr and closes the connection when the test
+// ends.
+func dialserver(t *testing.T, addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error connecting to %v: %v\n", addr, err.Error())
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestShutdown(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	s, addr, served := launchblockingserver(t, started, release)
+
+	// idle has been served a request and waits for the next one
+	idle := dialserver(t, addr)
+	idle_reader := bufio.NewReader(idle)
+	fmt.Fprint(idle, "GET /fast HTTP/1.1\r\nHost: website1\r\n\r\n")
+	resp, err := http.ReadResponse(idle_reader, nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	io.ReadAll(resp.Body)
+
+	// fresh is accepted before busy but sends its request during Shutdown
+	fresh := dialserver(t, addr)
+
+	busy := dialserver(t, addr)
+	fmt.Fprint(busy, "GET /slow HTTP/1.1\r\nHost: website1\r\n\r\n")
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+
+	select {
+	case err := <-served:
+		if err != tritonhttp.ErrServerClosed {
+			t.Fatalf("Expected Serve to return %v but got %v\n", tritonhttp.ErrServerClosed, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Serve did not return after Shutdown\n")
+	}
+
+	idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := idle_reader.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected the idle connection to be closed but read %v bytes, %v\n", n, err)
+	}
+
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Fatalf("Server still accepts connections after Shutdown\n")
+	}
+
+	fmt.Fprint(fresh, "GET /fast HTTP/1.1\r\nHost: website1\r\n\r\n")
+	fresh.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err = http.ReadResponse(bufio.NewReader(fresh), nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response on the new connection: %v\n", err.Error())
+	}
+	io.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || !resp.Close {
+		t.Fatalf("Expected a 200 response with Connection: close on the new connection but got %v, close %v\n", resp.StatusCode, resp.Close)
+	}
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v before the in-flight request finished\n", err)
+	default:
+	}
+
+	close(release)
+	busy.SetReadDeadline(time.Now().Add(2 * time.Second))
+	resp, err = http.ReadResponse(bufio.NewReader(busy), nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the in-flight response: %v\n", err.Error())
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || string(body) != "done" {
+		t.Fatalf("Expected the in-flight response to complete but got %q, %v\n", body, err)
+	}
+	if !resp.Close {
+		t.Fatalf("Expected Connection: close on the last response\n")
+	}
+
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatalf("Shutdown returned %v\n", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Shutdown did not return after the in-flight request finished\n")
+	}
+
+	if err := s.ListenAndServe(); err != tritonhttp.ErrServerClosed {
+		t.Fatalf("Expected ListenAndServe after Shutdown to return %v but got %v\n", tritonhttp.ErrServerClosed, err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	s, addr, _ := launchblockingserver(t, started, release)
+
+	busy := dialserver(t, addr)
+	fmt.Fprint(busy, "GET /slow HTTP/1.1\r\nHost: website1\r\n\r\n")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected Shutdown to give up with %v but got %v\n", context.DeadlineExceeded, err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close returned %v\n", err)
+	}
+	busy.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := busy.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("Expected Close to drop the connection but read %v bytes, %v\n", n, err)
+	}
+}
+
+func TestListenAndServe(t *testing.T) {
+	virtualHosts, err := tritonhttp.LoadConfig("../../virtual_hosts.yaml", "../../docroot_dirs")
+	if err != nil {
+		t.Fatalf("Error loading config: %v\n", err)
+	}
+	s := &tritonhttp.Server{
+		Addr:         "localhost:0",
+		VirtualHosts: virtualHosts,
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- s.ListenAndServe()
+	}()
+	t.Cleanup(func() { s.Close() })
+
+	var addr net.Addr
+	for deadline := time.Now().Add(2 * time.Second); addr == nil; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Server did not start listening\n")
+		}
+		time.Sleep(10 * time.Millisecond)
+		addr = s.ListenerAddr()
+	}
+	port := fmt.Sprint(addr.(*net.TCPAddr).Port)
+	if port == "0" {
+		t.Fatalf("Expected ListenerAddr to hold the port picked for :0\n")
+	}
+
+	req := "GET /index.html HTTP/1.1\r\nHost: website1\r\nConnection: close\r\n\r\n"
+	respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
+	if err != nil {
+		t.Fatalf("Error fetching request: %v\n", err.Error())
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(respbytes)), nil)
+	if err != nil {
+		t.Fatalf("got an error parsing the response: %v\n", err.Error())
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("Expected response code of 200 but got: %v\n", resp.StatusCode)
+	}
+
+	// the port is taken now, so a second server cannot listen on it
+	other := &tritonhttp.Server{Addr: addr.String()}
+	if err := other.ListenAndServe(); err == nil || err == tritonhttp.ErrServerClosed {
+		t.Fatalf("Expected ListenAndServe on a busy port to fail but got %v\n", err)
+	}
+
+	s.Close()
+	select {
+	case err := <-served:
+		if err != tritonhttp.ErrServerClosed {
+			t.Fatalf("Expected ListenAndServe to return %v but got %v\n", tritonhttp.ErrServerClosed, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("ListenAndServe did not return after Close\n")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	docroot := t.TempDir()
+	if err := os.Mkdir(filepath.Join(docroot, "site"), 0755); err != nil {
+		t.Fatalf("Error creating directory: %v\n", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(docroot, "file"), nil, 0644); err != nil {
+		t.Fatalf("Error writing file: %v\n", err.Error())
+	}
+
+	type problem struct {
+		line int
+		host string
+		err  error
+	}
+	tests := []struct {
+		name     string
+		config   string
+		problems []problem
+	}{
+		{"valid", "virtual_hosts:\n  - hostName: a\n    docRoot: site\n", nil},
+		{"syntax", "virtual_hosts:\n  - hostName: a\n   docRoot: site\n", []problem{
+			{2, "", tritonhttp.ErrConfigSyntax},
+		}},
+		{"unknown keys", "virtual_hosts:\n  - hostName: a\n    docRoot: site\n    colour: red\n    autoindex: true\n", []problem{
+			{4, "", tritonhttp.ErrUnknownConfigKey},
+			{5, "", tritonhttp.ErrUnknownConfigKey},
+		}},
+		{"duplicate hosts", "virtual_hosts:\n  - hostName: a\n    docRoot: site\n    default: true\n  - hostName: A\n    docRoot: site\n    aliases: [b, b]\n    default: true\n", []problem{
+			{0, "A", tritonhttp.ErrDuplicateHost},
+			{0, "A", tritonhttp.ErrDuplicateHost},
+			{0, "A", tritonhttp.ErrDuplicateHost},
+		}},
+		{"bad docroots", "virtual_hosts:\n  - hostName: a\n    docRoot: missing\n  - hostName: b\n    docRoot: file\n  - hostName: c\n", []problem{
+			{0, "a", tritonhttp.ErrInvalidDocRoot},
+			{0, "b", tritonhttp.ErrInvalidDocRoot},
+			{0, "c", tritonhttp.ErrInvalidDocRoot},
+		}},
+		{"bad host", "virtual_hosts:\n  - hostName: a\n    docRoot: site\n    symlinks: sometimes\n    redirects:\n      - from: /a\n", []problem{
+			{0, "a", tritonhttp.ErrInvalidVirtualHost},
+			{0, "a", tritonhttp.ErrInvalidVirtualHost},
+		}},
+		{"no hosts", "virtual_hosts: []\n", []problem{
+			{0, "", tritonhttp.ErrInvalidVirtualHost},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vhosts, err := tritonhttp.LoadConfig(writeconfig(t, tt.config), docroot)
+			if tt.problems == nil {
+				if err != nil {
+					t.Fatalf("Expected a valid config but got: %v\n", err)
+				}
+				if vhosts["a"] == nil || vhosts["a"].DocRoot != filepath.Join(docroot, "site") {
+					t.Fatalf("Expected host a with its docroot but got %v\n", vhosts)
+				}
+				return
+			}
+
+			config_err, ok := err.(*tritonhttp.ConfigError)
+			if !ok {
+				t.Fatalf("Expected a *ConfigError but got: %v\n", err)
+			}
+			if len(config_err.Problems) != len(tt.problems) {
+				t.Fatalf("Expected %v problems but got: %v\n", len(tt.problems), err)
+			}
+			for i, want := range tt.problems {
+				got := config_err.Problems[i]
+				if got.Line != want.line || got.Host != want.host || !errors.Is(got, want.err) {
+					t.Fatalf("Expected problem %v to be %v at line %v of host %q but got: %v\n", i, want.err, want.line, want.host, got)
+				}
+			}
+		})
+	}
+
+	t.Run("unreadable file", func(t *testing.T) {
+		_, err := tritonhttp.LoadConfig(filepath.Join(docroot, "missing.yaml"), docroot)
+		config_err, ok := err.(*tritonhttp.ConfigError)
+		if !ok || len(config_err.Problems) != 1 || !errors.Is(config_err.Problems[0], os.ErrNotExist) {
+			t.Fatalf("Expected a *ConfigError for the missing file but got: %v\n", err)
+		}
+	})
+}
+
+func TestReloadConfig(t *testing.T) {
+	docroot := t.TempDir()
+	for _, site := range []string{"one", "two"} {
+		if err := os.Mkdir(filepath.Join(docroot, site), 0755); err != nil {
+			t.Fatalf("Error creating directory: %v\n", err.Error())
+		}
+		if err := os.WriteFile(filepath.Join(docroot, site, "index.html"), []byte(site), 0644); err != nil {
+			t.Fatalf("Error writing file: %v\n", err.Error())
+		}
+	}
+	config_path := filepath.Join(t.TempDir(), "virtual_hosts.yaml")
+	setdocroot := func(docRoot string, mtime time.Time) {
+		config := "virtual_hosts:\n  - hostName: a\n    docRoot: " + docRoot + "\n"
+		if err := os.WriteFile(config_path, []byte(config), 0644); err != nil {
+			t.Fatalf("Error writing file: %v\n", err.Error())
+		}
+		// make the change visible to the watcher despite coarse timestamps
+		if err := os.Chtimes(config_path, mtime, mtime); err != nil {
+			t.Fatalf("Error setting file times: %v\n", err.Error())
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	setdocroot("one", start)
+
+	virtualHosts, err := tritonhttp.LoadConfig(config_path, docroot)
+	if err != nil {
+		t.Fatalf("Error loading config: %v\n", err)
+	}
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v\n", err.Error())
+	}
+	s := &tritonhttp.Server{VirtualHosts: virtualHosts}
+	go s.Serve(listener)
+	t.Cleanup(func() { s.Close() })
+
+	// get sends a request for a's index on conn and returns the body
+	get := func(conn net.Conn, br *bufio.Reader, connection string) string {
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: a\r\nConnection: "+connection+"\r\n\r\n")
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("got an error parsing the response: %v\n", err.Error())
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("Error reading response body: %v\n", err.Error())
+		}
+		return string(body)
+	}
+	getnew := func() string {
+		conn := dialserver(t, listener.Addr().String())
+		return get(conn, bufio.NewReader(conn), "close")
+	}
+
+	old := dialserver(t, listener.Addr().String())
+	old_reader := bufio.NewReader(old)
+	if body := get(old, old_reader, "keep-alive"); body != "one" {
+		t.Fatalf("Expected the first docroot but got %q\n", body)
+	}
+
+	setdocroot("two", start.Add(time.Minute))
+	if err := s.ReloadConfig(config_path, docroot); err != nil {
+		t.Fatalf("Error reloading config: %v\n", err)
+	}
+	if body := getnew(); body != "two" {
+		t.Fatalf("Expected a new connection to use the reloaded config but got %q\n", body)
+	}
+	if body := get(old, old_reader, "keep-alive"); body != "one" {
+		t.Fatalf("Expected an open connection to keep its config but got %q\n", body)
+	}
+
+	setdocroot("missing", start.Add(2*time.Minute))
+	if _, ok := s.ReloadConfig(config_path, docroot).(*tritonhttp.ConfigError); !ok {
+		t.Fatalf("Expected reloading a bad config to fail with a *ConfigError\n")
+	}
+	if body := getnew(); body != "two" {
+		t.Fatalf("Expected a bad config to keep the current one but got %q\n", body)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.WatchConfig(ctx, config_path, docroot, 10*time.Millisecond)
+	// keep changing the file, as the watcher may not have looked at it yet
+	for i, deadline := 0, time.Now().Add(2*time.Second); getnew() != "one"; i++ {
+		if time.Now().After(deadline) {
+			t.Fatalf("WatchConfig did not reload the changed config\n")
+		}
+		setdocroot("one", start.Add(time.Duration(3+i)*time.Minute))
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// serveon serves s on a free port until the test ends and returns its
+// address.
+func serveon(t *testing.T, s *tritonhttp.Server) string {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v\n", err.Error())
+	}
+	go s.Serve(listener)
+	t.Cleanup(func() { s.Close() })
+	return listener.Addr().String()
+}
+
+func TestTimeouts(t *testing.T) {
+	done := tritonhttp.HandlerFunc(func(w tritonhttp.ResponseWriter, req *tritonhttp.Request) {
+		w.Write([]byte("done"))
+	})
+	request := "GET / HTTP/1.1\r\nHost: a\r\n\r\n"
+
+	// readresponse reads a response from br and its body
+	readresponse := func(conn net.Conn, br *bufio.Reader) *http.Response {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("got an error parsing the response: %v\n", err.Error())
+		}
+		io.ReadAll(resp.Body)
+		return resp
+	}
+	// expectclosed checks that the server closes conn within a second
+	expectclosed := func(conn net.Conn, br *bufio.Reader) {
+		start := time.Now()
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if n, err := br.Read(make([]byte, 1)); err != io.EOF {
+			t.Fatalf("Expected the connection to be closed but read %v bytes, %v\n", n, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("Connection was closed after %v\n", elapsed)
+		}
+	}
+
+	t.Run("keep-alive header", func(t *testing.T) {
+		conn := dialserver(t, serveon(t, &tritonhttp.Server{Handler: done}))
+		fmt.Fprint(conn, request)
+		resp := readresponse(conn, bufio.NewReader(conn))
+		if resp.Header.Get("Keep-Alive") != "timeout=5" {
+			t.Fatalf("Expected Keep-Alive %q but got %q\n", "timeout=5", resp.Header.Get("Keep-Alive"))
+		}
+	})
+
+	t.Run("max requests per connection", func(t *testing.T) {
+		s := &tritonhttp.Server{Handler: done, IdleTimeout: 3 * time.Second, MaxRequestsPerConn: 2}
+		conn := dialserver(t, serveon(t, s))
+		br := bufio.NewReader(conn)
+		fmt.Fprint(conn, request+request)
+
+		resp := readresponse(conn, br)
+		if resp.Close || resp.Header.Get("Keep-Alive") != "timeout=3, max=1" {
+			t.Fatalf("Expected Keep-Alive %q but got %q, close %v\n", "timeout=3, max=1", resp.Header.Get("Keep-Alive"), resp.Close)
+		}
+		resp = readresponse(conn, br)
+		if !resp.Close || resp.Header.Get("Keep-Alive") != "" {
+			t.Fatalf("Expected Connection: close on the last response but got %v\n", resp.Header)
+		}
+		expectclosed(conn, br)
+	})
+
+	t.Run("idle timeout", func(t *testing.T) {
+		conn := dialserver(t, serveon(t, &tritonhttp.Server{Handler: done, IdleTimeout: 100 * time.Millisecond}))
+		br := bufio.NewReader(conn)
+		fmt.Fprint(conn, request)
+		// a timeout under a second is rounded up rather than sent as 0
+		if resp := readresponse(conn, br); resp.Header.Get("Keep-Alive") != "timeout=1" {
+			t.Fatalf("Expected Keep-Alive %q but got %q\n", "timeout=1", resp.Header.Get("Keep-Alive"))
+		}
+		expectclosed(conn, br)
+	})
+
+	t.Run("read header timeout", func(t *testing.T) {
+		s := &tritonhttp.Server{Handler: done, ReadHeaderTimeout: 100 * time.Millisecond}
+		conn := dialserver(t, serveon(t, s))
+		br := bufio.NewReader(conn)
+		fmt.Fprint(conn, "GET / HTTP/1.1\r\n")
+		resp := readresponse(conn, br)
+		if resp.StatusCode != 400 {
+			t.Fatalf("Expected response code of 400 but got: %v\n", resp.StatusCode)
+		}
+		expectclosed(conn, br)
+	})
+
+	t.Run("body never arrives", func(t *testing.T) {
+		// without a ReadTimeout the deadline of the head covers the body
+		s := &tritonhttp.Server{Handler: done, ReadHeaderTimeout: 100 * time.Millisecond}
+		conn := dialserver(t, serveon(t, s))
+		br := bufio.NewReader(conn)
+		fmt.Fprint(conn, "POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 100\r\n\r\n")
+		readresponse(conn, br)
+		expectclosed(conn, br)
+	})
+
+	t.Run("per host", func(t *testing.T) {
+		docroot := t.TempDir()
+		if err := os.WriteFile(filepath.Join(docroot, "index.html"), []byte("done"), 0644); err != nil {
+			t.Fatalf("Error writing file: %v\n", err.Error())
+		}
+		config := "virtual_hosts:\n" +
+			"  - hostName: a\n    docRoot: .\n" +
+			"  - hostName: b\n    docRoot: .\n    idleTimeout: 2s\n    maxRequestsPerConn: 3\n" +
+			"  - hostName: c\n    docRoot: .\n    maxRequestsPerConn: 1\n"
+		virtualHosts, err := tritonhttp.LoadConfig(writeconfig(t, config), docroot)
+		if err != nil {
+			t.Fatalf("Error loading config: %v\n", err)
+		}
+		addr := serveon(t, &tritonhttp.Server{VirtualHosts: virtualHosts, IdleTimeout: 7 * time.Second})
+
+		for _, tt := range []struct {
+			host      string
+			keepAlive string
+			close     bool
+		}{
+			{"a", "timeout=7", false},
+			{"b", "timeout=2, max=2", false},
+			{"c", "", true},
+		} {
+			conn := dialserver(t, addr)
+			fmt.Fprint(conn, "GET / HTTP/1.1\r\nHost: "+tt.host+"\r\n\r\n")
+			resp := readresponse(conn, bufio.NewReader(conn))
+			if resp.StatusCode != 200 || resp.Close != tt.close || resp.Header.Get("Keep-Alive") != tt.keepAlive {
+				t.Fatalf("Expected host %v to send Keep-Alive %q, close %v but got %v, %v\n", tt.host, tt.keepAlive, tt.close, resp.StatusCode, resp.Header)
+			}
+		}
+	})
+}
+
+func TestHandler(t *testing.T) {
+	virtualHosts, err := tritonhttp.LoadConfig(writeconfig(t, testVirtualHosts), "../../docroot_dirs")
+	if err != nil {
+		t.Fatalf("Error loading config: %v\n", err)
+	}
+	files := &tritonhttp.FileServer{VirtualHosts: virtualHosts}
+	streamed := strings.Repeat("0123456789", 1000)
+	missing := filepath.Join(t.TempDir(), "missing.html")
+
+	// /api/ is served by the functions below, everything else from files
+	mux := tritonhttp.HandlerFunc(func(w tritonhttp.ResponseWriter, req *tritonhttp.Request) {
+		switch req.Path {
+		case "/api/item":
+			w.Header()["X-Item"] = req.Query.Get("id")
+			w.Write([]byte("item " + req.Query.Get("id")))
+		case "/api/missing":
+			w.WriteHeader(404)
+			w.Write([]byte("no such item"))
+		case "/api/nofile":
+			tritonhttp.ServeFile(w, req, missing)
+		case "/api/status":
+			code, _ := strconv.Atoi(req.Query.Get("code"))
+			w.WriteHeader(code)
+		case "/api/invalid":
+			w.Header()["X-Err"] = "parse"
+			w.WriteHeader(400)
+			w.Write([]byte("invalid json"))
+		case "/api/stream":
+			w.Write([]byte(streamed[:10]))
+			w.(tritonhttp.Flusher).Flush()
+			w.Write([]byte(streamed[10:]))
+		default:
+			files.ServeHTTP(w, req)
+		}
+	})
+	addr := serveon(t, &tritonhttp.Server{VirtualHosts: virtualHosts, Handler: mux})
+
+	indexcontents, err := os.ReadFile("../../docroot_dirs/htdocs1/index.html")
+	if err != nil {
+		t.Fatalf("Error reading input file: %v\n", err.Error())
+	}
+
+	tests := []struct {
+		name    string
+		target  string
+		status  int
+		header  string
+		value   string
+		body    string
+		chunked bool
+	}{
+		{"buffered body", "/api/item?id=7", 200, "X-Item", "7", "item 7", false},
+		{"status", "/api/missing", 404, "Content-Length", "12", "no such item", false},
+		{"bad request", "/api/invalid", 400, "X-Err", "parse", "invalid json", false},
+		{"missing file", "/api/nofile", 404, "Content-Length", "0", "", false},
+		{"streamed body", "/api/stream", 200, "Content-Length", "", streamed, true},
+		{"file server", "/index.html", 200, "Content-Type", mime.TypeByExtension(".html"), string(indexcontents), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dialserver(t, addr)
+			fmt.Fprint(conn, "GET "+tt.target+" HTTP/1.1\r\nHost: website1\r\nConnection: close\r\n\r\n")
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("got an error parsing the response: %v\n", err.Error())
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Error reading response body: %v\n", err.Error())
+			}
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("Expected response code of %v but got: %v\n", tt.status, resp.StatusCode)
+			}
+			if resp.Header.Get(tt.header) != tt.value {
+				t.Fatalf("Expected %v %q but got %q\n", tt.header, tt.value, resp.Header.Get(tt.header))
+			}
+			if chunked := len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked"; chunked != tt.chunked {
+				t.Fatalf("Expected chunked %v but got Transfer-Encoding %v\n", tt.chunked, resp.TransferEncoding)
+			}
+			if string(body) != tt.body {
+				t.Fatalf("Expected a body of %v bytes but got %v bytes\n", len(tt.body), len(body))
+			}
+		})
+	}
+
+	// any status a handler picks goes out with a reason phrase
+	for _, status := range []string{"201 Created", "204 No Content", "403 Forbidden", "500 Internal Server Error", "503 Service Unavailable", "299 Success"} {
+		conn := dialserver(t, addr)
+		fmt.Fprint(conn, "GET /api/status?code="+status[:3]+" HTTP/1.1\r\nHost: website1\r\nConnection: close\r\n\r\n")
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatalf("got an error parsing the response: %v\n", err.Error())
+		}
+		resp.Body.Close()
+		if resp.Status != status {
+			t.Fatalf("Expected status %q but got %q\n", status, resp.Status)
+		}
+	}
+
+	// a 400 chosen by a handler leaves the connection open
+	conn := dialserver(t, addr)
+	fmt.Fprint(conn, "GET /api/invalid HTTP/1.1\r\nHost: website1\r\n\r\n"+
+		"GET /api/item?id=8 HTTP/1.1\r\nHost: website1\r\nConnection: close\r\n\r\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	br := bufio.NewReader(conn)
+	for _, want := range []int{400, 200} {
+		resp, err := http.ReadResponse(br, nil)
+		if err != nil {
+			t.Fatalf("got an error parsing the response: %v\n", err.Error())
+		}
+		io.ReadAll(resp.Body)
+		if resp.StatusCode != want {
+			t.Fatalf("Expected response code of %v but got: %v\n", want, resp.StatusCode)
+		}
+	}
+}
+
+func TestHandlerTrailers(t *testing.T) {
+	addr := serveon(t, &tritonhttp.Server{Handler: tritonhttp.HandlerFunc(func(w tritonhttp.ResponseWriter, req *tritonhttp.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		w.Header()["Trailer"] = "X-Sum, X-Early"
+		w.Header()["X-Early"] = "set before the body"
+		w.Write(body)
+		// the request trailer comes back as the response trailer
+		w.Header()["X-Sum"] = req.Trailer["X-Checksum"]
+	})})
+
+	for _, tt := range []struct {
+		name string
+		body string
+	}{
+		{"buffered body", "hello world"},
+		{"streamed body", strings.Repeat("0123456789", 1000)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dialserver(t, addr)
+			fmt.Fprint(conn, "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\nConnection: close\r\n\r\n",
+				strconv.FormatInt(int64(len(tt.body)), 16)+"\r\n"+tt.body+"\r\n",
+				"0\r\nX-Checksum: 42\r\n\r\n")
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("got an error parsing the response: %v\n", err.Error())
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("Error reading response body: %v\n", err.Error())
+			}
+
+			if resp.StatusCode != 200 || string(body) != tt.body {
+				t.Fatalf("Expected the body echoed with 200 but got %v and %v bytes\n", resp.StatusCode, len(body))
+			}
+			for _, key := range []string{"X-Sum", "X-Early"} {
+				if resp.Header.Get(key) != "" {
+					t.Fatalf("Expected trailer field %v only in the trailer but got it in the header\n", key)
+				}
+			}
+			if resp.Trailer.Get("X-Sum") != "42" || resp.Trailer.Get("X-Early") != "set before the body" {
+				t.Fatalf("Expected the trailer fields but got %v\n", resp.Trailer)
+			}
+		})
+	}
+}
+
+func TestAllFilesInHtdocs(t *testing.T) {
+	port := launchhttpd(t)
+
+	virtualHosts, err := tritonhttp.LoadConfig("../../virtual_hosts.yaml", "../../docroot_dirs")
+	if err != nil {
+		t.Fatalf("Error loading config: %v\n", err)
+	}
+
+	for hostname, vhost := range virtualHosts {
+		if hostname != vhost.HostName {
+			// aliases share the docroot of their host
+			continue
+		}
+		docRoot := vhost.DocRoot
 
 		err := filepath.Walk(docRoot, func(path string, info os.FileInfo, err error) error {
 			if err != nil {
@@ -242,7 +2530,7 @@ func TestAllFilesInHtdocs(t *testing.T) {
 					"User-Agent: gotest\r\n"+
 					"\r\n", testfile)
 
-				respbytes, _, err := tritonhttp.Fetch("localhost", "8080", []byte(req))
+				respbytes, _, err := tritonhttp.Fetch("localhost", port, []byte(req))
 				if err != nil {
 					t.Fatalf("Error fetching request: %v\n", err.Error())
 				}
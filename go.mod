@@ -2,4 +2,4 @@ module cse224
 
 go 1.19
 
-require gopkg.in/yaml.v2 v2.4.0 // indirect
+require gopkg.in/yaml.v2 v2.4.0
@@ -0,0 +1,168 @@
+package tritonhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dirEntry is one row of a directory listing.
+type dirEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	IsDir   bool      `json:"isDir"`
+}
+
+// isHidden reports whether a directory entry is left out of listings.
+// Dotfiles such as ".htaccess" or ".git" are never listed.
+func isHidden(name string) bool {
+	return strings.HasPrefix(name, ".")
+}
+
+// readDirEntries returns the visible entries of the directory dir_path
+// under doc_root. Entries that symlinks forbids serving are left out, and
+// links that are followed are listed with the size and time of their
+// target.
+func readDirEntries(doc_root string, dir_path string, symlinks SymlinkPolicy) ([]dirEntry, error) {
+	infos, err := os.ReadDir(dir_path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []dirEntry
+	for _, info := range infos {
+		if isHidden(info.Name()) {
+			continue
+		}
+		entry_path, ok := resolvePath(doc_root, filepath.Join(dir_path, info.Name()), symlinks)
+		if !ok {
+			continue
+		}
+		file_info, err := os.Stat(entry_path)
+		if err != nil {
+			// the entry vanished while listing, or is a dangling link
+			continue
+		}
+		entries = append(entries, dirEntry{
+			Name:    info.Name(),
+			Size:    file_info.Size(),
+			ModTime: file_info.ModTime().UTC(),
+			IsDir:   file_info.IsDir(),
+		})
+	}
+	return entries, nil
+}
+
+// sortDirEntries orders entries by the "sort" (name, size or mtime) and
+// "order" (asc or desc) query parameters. Directories always come first.
+func sortDirEntries(entries []dirEntry, query url.Values) (string, string) {
+	column := query.Get("sort")
+	if column != "size" && column != "mtime" {
+		column = "name"
+	}
+	order := query.Get("order")
+	if order != "desc" {
+		order = "asc"
+	}
+
+	less := func(a, b dirEntry) bool {
+		switch column {
+		case "size":
+			if a.Size != b.Size {
+				return a.Size < b.Size
+			}
+		case "mtime":
+			if !a.ModTime.Equal(b.ModTime) {
+				return a.ModTime.Before(b.ModTime)
+			}
+		}
+		return a.Name < b.Name
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].IsDir != entries[j].IsDir {
+			return entries[i].IsDir
+		}
+		if order == "desc" {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+	return column, order
+}
+
+// serveDirListing replies with a listing of dir_path, which is served at
+// url_path out of doc_root under symlinks. Clients asking for
+// application/json get a JSON array, everyone else an HTML page.
+func serveDirListing(w ResponseWriter, req *Request, doc_root string, symlinks SymlinkPolicy, dir_path string, url_path string, raw_query string) {
+	entries, err := readDirEntries(doc_root, dir_path, symlinks)
+	if err != nil {
+		fmt.Println("Error listing directory", dir_path, err)
+		w.WriteHeader(statusFileNotFound)
+		return
+	}
+	query, _ := url.ParseQuery(raw_query)
+	column, order := sortDirEntries(entries, query)
+
+	w.Header()["Vary"] = "Accept"
+	if strings.Contains(req.Headers.list("Accept"), "application/json") {
+		body, err := json.Marshal(entries)
+		if err != nil {
+			fmt.Println("Error encoding directory listing", err)
+			w.WriteHeader(statusFileNotFound)
+			return
+		}
+		if entries == nil {
+			body = []byte("[]")
+		}
+		w.Header()["Content-Type"] = "application/json"
+		w.Write(body)
+		return
+	}
+
+	w.Header()["Content-Type"] = "text/html; charset=utf-8"
+	w.Write(renderDirListing(entries, url_path, column, order))
+}
+
+// renderDirListing renders entries as an HTML table whose column headers
+// link to the listing sorted by that column.
+func renderDirListing(entries []dirEntry, url_path string, column string, order string) []byte {
+	var buf bytes.Buffer
+	title := html.EscapeString("Index of " + url_path)
+
+	fmt.Fprintf(&buf, "<html>\n<head>\n<title>%s</title>\n</head>\n<body>\n<h1>%s</h1>\n<table>\n<tr>", title, title)
+	for _, c := range []struct{ key, label string }{{"name", "Name"}, {"size", "Size"}, {"mtime", "Last modified"}} {
+		next := "asc"
+		if c.key == column && order == "asc" {
+			next = "desc"
+		}
+		fmt.Fprintf(&buf, `<th><a href="?sort=%s&amp;order=%s">%s</a></th>`, c.key, next, c.label)
+	}
+	buf.WriteString("</tr>\n")
+
+	if url_path != "/" {
+		buf.WriteString(`<tr><td><a href="../">../</a></td><td>-</td><td>-</td></tr>` + "\n")
+	}
+	for _, entry := range entries {
+		name, size := entry.Name, strconv.FormatInt(entry.Size, 10)
+		if entry.IsDir {
+			name, size = name+"/", "-"
+		}
+		href := (&url.URL{Path: name}).String()
+		if strings.Contains(name, ":") {
+			// keep names like "a:b" from being read as a URL scheme
+			href = "./" + href
+		}
+		fmt.Fprintf(&buf, "<tr><td><a href=\"%s\">%s</a></td><td>%s</td><td>%s</td></tr>\n",
+			html.EscapeString(href), html.EscapeString(name), size, FormatTime(entry.ModTime))
+	}
+	buf.WriteString("</table>\n</body>\n</html>\n")
+	return buf.Bytes()
+}
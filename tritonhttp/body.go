@@ -0,0 +1,148 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// defaultMaxBodyBytes is the largest request body accepted when
+// Server.MaxBodyBytes is 0.
+const defaultMaxBodyBytes int64 = 10 << 20
+
+// methodNeedsLength reports whether requests using method must declare
+// the length of their body.
+func methodNeedsLength(method string) bool {
+	return method == methodPost || method == methodPut
+}
+
+// setupBody attaches the body that follows the headers of req on br to
+// req.Body, framed either by chunked transfer coding or by its
+// Content-Length. It returns statusOK, or the status to reject the request
+// with when the framing is missing, invalid, unsupported or larger than
+// max_body. A rejected request's body cannot be skipped, so the
+// connection is marked to be closed.
+func setupBody(br *bufio.Reader, req *Request, max_body int64) int {
+	req.Body = io.LimitReader(br, 0)
+
+	if _, ok := req.Headers["Transfer-Encoding"]; ok {
+		coding := req.Headers.list("Transfer-Encoding")
+		if _, ok := req.Headers["Content-Length"]; ok {
+			fmt.Println("Both Transfer-Encoding and Content-Length are present")
+			req.Close = true
+			return statusBadRequest
+		}
+		if !strings.EqualFold(strings.TrimSpace(coding), "chunked") {
+			fmt.Println("Unsupported Transfer-Encoding", coding)
+			req.Close = true
+			return statusNotImplemented
+		}
+		cr := NewChunkedReader(br)
+		req.ContentLength = -1
+		req.Trailer = cr.Trailer
+		req.Body = &maxBytesReader{r: cr, remaining: max_body}
+		return statusOK
+	}
+
+	values, ok := req.Headers["Content-Length"]
+	if !ok {
+		if methodNeedsLength(req.Method) {
+			fmt.Println("Missing Content-Length for", req.Method)
+			req.Close = true
+			return statusLengthRequired
+		}
+		return statusOK
+	}
+
+	value, ok := sameValue(values)
+	length, err := strconv.ParseInt(value, 10, 64)
+	if !ok || !isDigits(value) || err != nil {
+		fmt.Println("Invalid Content-Length", value)
+		req.Close = true
+		return statusBadRequest
+	}
+
+	if length > max_body {
+		fmt.Println("Content-Length", length, "exceeds the limit of", max_body)
+		req.Close = true
+		return statusPayloadTooLarge
+	}
+
+	req.ContentLength = length
+	req.Body = io.LimitReader(br, length)
+	return statusOK
+}
+
+// isDigits reports whether s is a non-empty run of ASCII digits, the
+// only form of a length allowed; ParseInt alone would also take a sign.
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// sameValue returns the value of a field that may only have one, such as
+// Content-Length. Repeating the same value, in several fields or as a
+// list, is tolerated; ok is false when the values differ.
+func sameValue(values []string) (value string, ok bool) {
+	for _, field := range values {
+		for _, item := range strings.Split(field, ",") {
+			item = trimOWS(item)
+			if value != "" && item != value {
+				fmt.Println("Conflicting values", values)
+				return "", false
+			}
+			value = item
+		}
+	}
+	return value, true
+}
+
+// maxBytesReader fails with errBodyTooLarge once more than remaining
+// bytes have been read from r. It guards bodies whose length is not
+// known up front.
+type maxBytesReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (mr *maxBytesReader) Read(p []byte) (int, error) {
+	if mr.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+	// read one byte more than allowed to notice bodies that are too large
+	if int64(len(p)) > mr.remaining+1 {
+		p = p[:mr.remaining+1]
+	}
+	n, err := mr.r.Read(p)
+	mr.remaining -= int64(n)
+	if mr.remaining < 0 {
+		fmt.Println("Request body exceeds the size limit")
+		return n + int(mr.remaining), errBodyTooLarge
+	}
+	return n, err
+}
+
+// discardBody reads whatever the handler left unread of req.Body, so that
+// the next request on the connection starts at the right place.
+func discardBody(req *Request) error {
+	if req == nil || req.Body == nil {
+		return nil
+	}
+	n, err := io.Copy(io.Discard, req.Body)
+	if n > 0 {
+		fmt.Println("Discarded", n, "unread body bytes")
+	}
+	return err
+}
@@ -0,0 +1,218 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+var errMalformedChunk = errors.New("malformed chunked encoding")
+
+// Limits on the lines of a chunked body, which are read before any size
+// is known: a chunk-size line with its extensions, a trailer field, and
+// the number of trailer fields.
+const (
+	maxChunkSizeLineBytes = 4 << 10
+	maxTrailerFieldBytes  = defaultMaxHeaderFieldBytes
+	maxTrailerFields      = defaultMaxHeaderCount
+)
+
+// ChunkedReader decodes a body sent with "Transfer-Encoding: chunked".
+// It returns io.EOF after the last chunk, once the trailer section has
+// been read into Trailer.
+type ChunkedReader struct {
+	// Trailer holds the trailer fields that followed the last chunk,
+	// keyed in canonical form. It is filled in when Read returns io.EOF.
+	Trailer map[string]string
+
+	br        *bufio.Reader
+	remaining int64 // bytes left in the current chunk
+	inChunk   bool  // whether the CRLF ending a chunk is still unread
+	err       error
+}
+
+// NewChunkedReader returns a ChunkedReader decoding the chunks read from br.
+func NewChunkedReader(br *bufio.Reader) *ChunkedReader {
+	return &ChunkedReader{
+		Trailer: make(map[string]string),
+		br:      br,
+	}
+}
+
+func (cr *ChunkedReader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+
+	if cr.remaining == 0 {
+		if cr.inChunk {
+			if err := cr.readChunkEnd(); err != nil {
+				cr.err = err
+				return 0, err
+			}
+			cr.inChunk = false
+		}
+
+		size, err := cr.readChunkSize()
+		if err != nil {
+			cr.err = err
+			return 0, err
+		}
+		if size == 0 {
+			cr.err = cr.readTrailer()
+			if cr.err == nil {
+				cr.err = io.EOF
+			}
+			return 0, cr.err
+		}
+		cr.remaining = size
+		cr.inChunk = true
+	}
+
+	if int64(len(p)) > cr.remaining {
+		p = p[:cr.remaining]
+	}
+	n, err := cr.br.Read(p)
+	cr.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		cr.err = err
+	}
+	return n, err
+}
+
+// readLine reads a line of at most max bytes and strips its ending.
+func (cr *ChunkedReader) readLine(max int) (string, error) {
+	line, err := readLimitedLine(cr.br, max)
+	if err == errLineTooLong {
+		fmt.Println("Line longer than", max, "bytes in chunked body")
+		return "", errMalformedChunk
+	}
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\n")
+	return strings.TrimSuffix(line, "\r"), nil
+}
+
+// readChunkSize reads a chunk-size line, ignoring any chunk extensions.
+func (cr *ChunkedReader) readChunkSize() (int64, error) {
+	line, err := cr.readLine(maxChunkSizeLineBytes)
+	if err != nil {
+		return 0, err
+	}
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.TrimRight(line, " \t")
+	size, err := strconv.ParseInt(line, 16, 64)
+	if !isHexDigits(line) || err != nil {
+		fmt.Println("Invalid chunk size", line)
+		return 0, errMalformedChunk
+	}
+	return size, nil
+}
+
+// isHexDigits reports whether s is a non-empty run of hex digits, the
+// only form of a chunk size allowed; ParseInt alone would also take a
+// sign.
+func isHexDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// readChunkEnd consumes the CRLF that follows the data of a chunk.
+func (cr *ChunkedReader) readChunkEnd() error {
+	line, err := cr.readLine(maxChunkSizeLineBytes)
+	if err != nil {
+		return err
+	}
+	if line != "" {
+		fmt.Println("Chunk data longer than its size")
+		return errMalformedChunk
+	}
+	return nil
+}
+
+// readTrailer reads the trailer fields up to the blank line ending the body.
+func (cr *ChunkedReader) readTrailer() error {
+	for fields := 0; ; fields++ {
+		line, err := cr.readLine(maxTrailerFieldBytes)
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			return nil
+		}
+		if fields == maxTrailerFields {
+			fmt.Println("More than", maxTrailerFields, "trailer fields")
+			return errMalformedChunk
+		}
+		key, value, found := strings.Cut(line, ":")
+		if !found || !validToken(key) {
+			fmt.Println("Invalid trailer field", line)
+			return errMalformedChunk
+		}
+		cr.Trailer[CanonicalHeaderKey(key)] = strings.TrimSpace(value)
+	}
+}
+
+// ChunkedWriter encodes a body with "Transfer-Encoding: chunked". Every
+// Write becomes one chunk; Close writes the last chunk and Trailer.
+type ChunkedWriter struct {
+	// Trailer holds the trailer fields written by Close.
+	Trailer map[string]string
+
+	w io.Writer
+}
+
+// NewChunkedWriter returns a ChunkedWriter writing chunks to w.
+func NewChunkedWriter(w io.Writer) *ChunkedWriter {
+	return &ChunkedWriter{w: w}
+}
+
+func (cw *ChunkedWriter) Write(p []byte) (int, error) {
+	// a chunk of size 0 would end the body early
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if _, err := io.WriteString(cw.w, strconv.FormatInt(int64(len(p)), 16)+"\r\n"); err != nil {
+		return 0, err
+	}
+	n, err := cw.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if _, err := io.WriteString(cw.w, "\r\n"); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// Close ends the body. It does not close the underlying writer.
+func (cw *ChunkedWriter) Close() error {
+	if _, err := io.WriteString(cw.w, "0\r\n"); err != nil {
+		return err
+	}
+	if err := sortAndWrite(cw.Trailer, cw.w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(cw.w, "\r\n")
+	return err
+}
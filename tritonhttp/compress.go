@@ -0,0 +1,232 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// defaultCompressMinSize is the smallest file compressed on the fly when
+// FileOptions.CompressMinSize is 0. Below it the savings do not pay for
+// the chunked framing.
+const defaultCompressMinSize int64 = 1024
+
+const (
+	encodingBrotli   = "br"
+	encodingGzip     = "gzip"
+	encodingDeflate  = "deflate"
+	encodingIdentity = "identity"
+)
+
+// precompressedSuffixes maps the content codings that may be served from
+// a precompressed sibling file to the suffix of its name, e.g.
+// "index.html.gz" next to "index.html".
+var precompressedSuffixes = map[string]string{
+	encodingBrotli: ".br",
+	encodingGzip:   ".gz",
+}
+
+// precompressedOrder is the order of preference among precompressed
+// siblings the client rates equally.
+var precompressedOrder = []string{encodingBrotli, encodingGzip}
+
+// compressibleTypes lists the non-text MIME types worth compressing.
+var compressibleTypes = map[string]bool{
+	"application/javascript": true,
+	"application/json":       true,
+	"application/xml":        true,
+	"image/svg+xml":          true,
+}
+
+// isCompressible reports whether a body of the given content type is
+// likely to shrink when compressed.
+func isCompressible(contentType string) bool {
+	media_type := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	return strings.HasPrefix(media_type, "text/") || compressibleTypes[media_type]
+}
+
+// parseAcceptEncoding parses an Accept-Encoding header into a map from
+// lower-cased content coding (or "*") to its q-value.
+func parseAcceptEncoding(value string) map[string]float64 {
+	accepted := make(map[string]float64)
+	for _, item := range strings.Split(value, ",") {
+		params := strings.Split(item, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			key, val, found := strings.Cut(strings.TrimSpace(param), "=")
+			if !found || strings.ToLower(strings.TrimSpace(key)) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(val), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				fmt.Println("Ignoring invalid q-value in Accept-Encoding", item)
+				parsed = 0
+			}
+			q = parsed
+		}
+		accepted[coding] = q
+	}
+	return accepted
+}
+
+// negotiateEncoding picks the content coding out of supported, in order
+// of preference, that the Accept-Encoding header value rates highest.
+// It returns "" when the body should be sent as is.
+func negotiateEncoding(value string, supported []string) string {
+	accepted := parseAcceptEncoding(value)
+	qvalue := func(coding string) float64 {
+		if q, ok := accepted[coding]; ok {
+			return q
+		}
+		if q, ok := accepted["*"]; ok {
+			return q
+		}
+		if coding == encodingIdentity {
+			return 1
+		}
+		return 0
+	}
+
+	best, best_q := "", 0.0
+	for _, coding := range supported {
+		if q := qvalue(coding); q > best_q {
+			best, best_q = coding, q
+		}
+	}
+	if best_q < qvalue(encodingIdentity) {
+		return ""
+	}
+	return best
+}
+
+// compressible reports whether the file described by file_info may be
+// compressed on the fly under the options of res. Responses for such
+// files depend on Accept-Encoding, so they carry a Vary header.
+func (res *Response) compressible(file_info os.FileInfo) bool {
+	opts := res.fileOptions()
+	if opts.DisableCompression {
+		return false
+	}
+	if file_info.Size() < opts.compressMinSize() {
+		return false
+	}
+	return isCompressible(MIMETypeByExtension(path.Ext(res.FilePath)))
+}
+
+// selectEncoding returns the content coding to compress the file with,
+// or "" to send it uncompressed. Range requests are always answered from
+// the uncompressed file.
+func (res *Response) selectEncoding(file_info os.FileInfo) string {
+	if res.Request == nil || !res.compressible(file_info) {
+		return ""
+	}
+	if res.Request.Method != methodGet && res.Request.Method != methodHead {
+		return ""
+	}
+	if _, ok := res.Request.Headers["Range"]; ok {
+		return ""
+	}
+	if _, ok := res.Request.Headers["Accept-Encoding"]; !ok {
+		return ""
+	}
+	return negotiateEncoding(res.Request.Headers.list("Accept-Encoding"), []string{encodingGzip, encodingDeflate})
+}
+
+// precompressedFile is a precompressed sibling of a served file.
+type precompressedFile struct {
+	path     string
+	info     os.FileInfo
+	encoding string
+}
+
+// findPrecompressed returns the precompressed siblings of res.FilePath
+// that exist as regular files, in order of preference.
+func (res *Response) findPrecompressed() []precompressedFile {
+	opts := res.fileOptions()
+	if opts.DisablePrecompressed {
+		return nil
+	}
+	var siblings []precompressedFile
+	for _, encoding := range precompressedOrder {
+		sibling_path := res.FilePath + precompressedSuffixes[encoding]
+		info, err := os.Stat(sibling_path)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if opts.docRoot != "" {
+			// a sibling may be a link even when the file itself is not
+			var ok bool
+			if sibling_path, ok = resolvePath(opts.docRoot, sibling_path, opts.symlinks); !ok {
+				continue
+			}
+		}
+		siblings = append(siblings, precompressedFile{sibling_path, info, encoding})
+	}
+	return siblings
+}
+
+// selectPrecompressed returns the sibling the request's Accept-Encoding
+// rates highest, or nil to fall back to the original file.
+func (res *Response) selectPrecompressed(siblings []precompressedFile) *precompressedFile {
+	if len(siblings) == 0 || res.Request == nil {
+		return nil
+	}
+	if res.Request.Method != methodGet && res.Request.Method != methodHead {
+		return nil
+	}
+	if _, ok := res.Request.Headers["Accept-Encoding"]; !ok {
+		return nil
+	}
+
+	var encodings []string
+	for _, sibling := range siblings {
+		encodings = append(encodings, sibling.encoding)
+	}
+	best := negotiateEncoding(res.Request.Headers.list("Accept-Encoding"), encodings)
+	for i := range siblings {
+		if siblings[i].encoding == best {
+			return &siblings[i]
+		}
+	}
+	return nil
+}
+
+// encodingETag derives the entity tag of an encoded representation from
+// the tag of the original file, so caches never mix the two up.
+func encodingETag(etag string, encoding string) string {
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+// newEncoder returns a writer compressing into w with the given coding.
+// The "deflate" coding is the zlib format, as the HTTP spec requires.
+func newEncoder(encoding string, w io.Writer) io.WriteCloser {
+	if encoding == encodingDeflate {
+		return zlib.NewWriter(w)
+	}
+	return gzip.NewWriter(w)
+}
+
+// writeCompressed writes the file at filePath into bw compressed with the
+// given coding and framed with chunked transfer coding, since the
+// compressed size is only known at the end.
+func writeCompressed(bw *bufio.Writer, filePath string, size int64, encoding string) error {
+	cw := NewChunkedWriter(bw)
+	enc := newEncoder(encoding, cw)
+	if err := writeFile(enc, filePath, 0, size); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	return cw.Close()
+}
@@ -0,0 +1,81 @@
+package tritonhttp
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// checkPreconditions evaluates the conditional request headers of
+// res.Request against the file described by file_info and its entity tag,
+// in the order given by RFC 7232 section 6. It returns statusOK when the
+// file should be served normally, statusNotModified when the client's
+// cached copy is still fresh, or statusPreconditionFailed when a
+// precondition fails.
+func (res *Response) checkPreconditions(file_info os.FileInfo, etag string) int {
+	if res.Request == nil || res.Request.Headers == nil {
+		return statusOK
+	}
+	headers := res.Request.Headers
+	modtime := file_info.ModTime()
+	method := res.Request.Method
+
+	if _, ok := headers["If-Match"]; ok {
+		if tags, ok := parseETagList(headers.list("If-Match")); ok && !etagMatch(tags, etag, true) {
+			fmt.Println("If-Match precondition failed for", etag)
+			return statusPreconditionFailed
+		}
+	} else if _, ok := headers["If-Unmodified-Since"]; ok {
+		if !checkIfUnmodifiedSince(headers.Get("If-Unmodified-Since"), modtime) {
+			fmt.Println("If-Unmodified-Since precondition failed")
+			return statusPreconditionFailed
+		}
+	}
+
+	if _, ok := headers["If-None-Match"]; ok {
+		if tags, ok := parseETagList(headers.list("If-None-Match")); ok && etagMatch(tags, etag, false) {
+			fmt.Println("If-None-Match matched", etag)
+			if method == methodGet || method == methodHead {
+				return statusNotModified
+			}
+			return statusPreconditionFailed
+		}
+	} else if value := headers.Get("If-Modified-Since"); value != "" && (method == methodGet || method == methodHead) {
+		if !checkIfModifiedSince(value, modtime) {
+			fmt.Println("Not modified since", value)
+			return statusNotModified
+		}
+	}
+
+	return statusOK
+}
+
+// checkIfUnmodifiedSince reports whether the If-Unmodified-Since condition
+// holds, i.e. the file has not been modified after the given date.
+// An unparsable date makes the header be ignored.
+func checkIfUnmodifiedSince(value string, modtime time.Time) bool {
+	t, err := ParseTime(value)
+	if err != nil {
+		fmt.Println("Ignoring invalid If-Unmodified-Since date", value)
+		return true
+	}
+	return !truncateModTime(modtime).After(t)
+}
+
+// checkIfModifiedSince reports whether the If-Modified-Since condition
+// holds, i.e. the file has been modified after the given date.
+// An unparsable date makes the header be ignored.
+func checkIfModifiedSince(value string, modtime time.Time) bool {
+	t, err := ParseTime(value)
+	if err != nil {
+		fmt.Println("Ignoring invalid If-Modified-Since date", value)
+		return true
+	}
+	return truncateModTime(modtime).After(t)
+}
+
+// truncateModTime drops the sub-second part of modtime, since HTTP dates
+// only have a resolution of one second.
+func truncateModTime(modtime time.Time) time.Time {
+	return modtime.Truncate(time.Second)
+}
@@ -0,0 +1,219 @@
+package tritonhttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	ErrConfigSyntax       = errors.New("invalid YAML")
+	ErrUnknownConfigKey   = errors.New("unknown key")
+	ErrDuplicateHost      = errors.New("duplicate host name")
+	ErrInvalidDocRoot     = errors.New("invalid docroot")
+	ErrInvalidVirtualHost = errors.New("invalid virtual host")
+)
+
+// ConfigProblem is one problem found in a virtual hosts config file.
+type ConfigProblem struct {
+	Line int    // line of the file the problem is on, or 0 if not known
+	Host string // hostName of the entry with the problem, if any
+	Err  error  // one of the ErrConfig* values above, or an *os.PathError
+}
+
+func (p ConfigProblem) Error() string {
+	var prefix string
+	if p.Line > 0 {
+		prefix += fmt.Sprintf("line %d: ", p.Line)
+	}
+	if p.Host != "" {
+		prefix += fmt.Sprintf("host %s: ", p.Host)
+	}
+	return prefix + p.Err.Error()
+}
+
+func (p ConfigProblem) Unwrap() error {
+	return p.Err
+}
+
+// ConfigError is returned by LoadConfig for a config file with problems.
+// It lists all of them rather than just the first.
+type ConfigError struct {
+	File     string
+	Problems []ConfigProblem
+}
+
+func (e *ConfigError) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d problem(s) in config", e.File, len(e.Problems))
+	for _, problem := range e.Problems {
+		b.WriteString("\n\t")
+		b.WriteString(problem.Error())
+	}
+	return b.String()
+}
+
+// yamlErrorLine and yamlUnknownField match the messages of yaml errors
+// that give a line and that report an unknown key.
+var (
+	yamlErrorLine    = regexp.MustCompile(`^line (\d+): (.*)$`)
+	yamlUnknownField = regexp.MustCompile(`^field (\S+) not found in type`)
+)
+
+// LoadConfig reads the virtual hosts in the config file and returns them
+// keyed by host name, alias and wildcard, with their DocRoot joined to
+// docroot_dirs_path and their rules compiled, ready for Server. The file
+// is checked as a whole: if anything is wrong, such as YAML syntax, an
+// unknown key, a host name served twice or a docroot that is not a
+// readable directory, LoadConfig returns a *ConfigError listing every
+// problem.
+func LoadConfig(vhConfigFilePath string, docroot_dirs_path string) (map[string]*VirtualHost, error) {
+	config_err := &ConfigError{File: vhConfigFilePath}
+
+	f, err := ioutil.ReadFile(vhConfigFilePath)
+	if err != nil {
+		config_err.Problems = append(config_err.Problems, ConfigProblem{Err: err})
+		return nil, config_err
+	}
+
+	vhostConfigs := VHConfigs{}
+	if err := yaml.UnmarshalStrict(f, &vhostConfigs); err != nil {
+		config_err.Problems = append(config_err.Problems, yamlProblems(err)...)
+		if _, ok := err.(*yaml.TypeError); !ok {
+			// a syntax error leaves nothing to check
+			return nil, config_err
+		}
+	}
+	if len(vhostConfigs.VirtualHosts) == 0 {
+		config_err.Problems = append(config_err.Problems, ConfigProblem{
+			Err: fmt.Errorf("%w: no virtual_hosts", ErrInvalidVirtualHost),
+		})
+	}
+
+	vh_map := make(map[string]*VirtualHost)
+	for i := range vhostConfigs.VirtualHosts {
+		vhost := &vhostConfigs.VirtualHosts[i]
+		problem := func(kind error, format string, args ...interface{}) {
+			host := vhost.HostName
+			if host == "" {
+				host = fmt.Sprintf("#%d", i+1)
+			}
+			config_err.Problems = append(config_err.Problems, ConfigProblem{
+				Host: host,
+				Err:  fmt.Errorf("%w: "+format, append([]interface{}{kind}, args...)...),
+			})
+		}
+
+		if vhost.HostName == "" {
+			problem(ErrInvalidVirtualHost, "no hostName")
+		}
+
+		if vhost.DocRoot == "" {
+			problem(ErrInvalidDocRoot, "no docRoot")
+		} else {
+			vhost.DocRoot = filepath.Join(docroot_dirs_path, vhost.DocRoot)
+			if err := checkDocRoot(vhost.DocRoot); err != nil {
+				problem(ErrInvalidDocRoot, "%v", err)
+			}
+		}
+
+		if !vhost.Symlinks.valid() {
+			problem(ErrInvalidVirtualHost, "unknown symlinks policy %q", vhost.Symlinks)
+		}
+
+		if err := vhost.Rules.Compile(); err != nil {
+			problem(ErrInvalidVirtualHost, "%v", err)
+		}
+
+		headers := make(map[string]string)
+		for key, value := range vhost.Headers {
+			headers[CanonicalHeaderKey(key)] = value
+		}
+		vhost.Headers = headers
+
+		// request hosts are lower-cased before the lookup
+		names := append([]string{vhost.HostName}, vhost.Aliases...)
+		for _, name := range names {
+			key := strings.ToLower(name)
+			if key == "" {
+				continue
+			}
+			if other, ok := vh_map[key]; ok {
+				if other == vhost {
+					problem(ErrDuplicateHost, "%q is listed twice", name)
+				} else {
+					problem(ErrDuplicateHost, "%q is already served by host %s", name, other.HostName)
+				}
+				continue
+			}
+			vh_map[key] = vhost
+		}
+		if vhost.Default {
+			if other, ok := vh_map[defaultHostName]; ok {
+				problem(ErrDuplicateHost, "host %s is the default host already", other.HostName)
+			} else {
+				vh_map[defaultHostName] = vhost
+			}
+		}
+	}
+
+	if len(config_err.Problems) > 0 {
+		return nil, config_err
+	}
+	return vh_map, nil
+}
+
+// checkDocRoot returns why path cannot serve as a docroot, or nil if it
+// is a readable directory.
+func checkDocRoot(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	if _, err := dir.Readdirnames(1); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// yamlProblems turns the error of yaml.UnmarshalStrict into problems,
+// taking their line numbers out of the messages.
+func yamlProblems(err error) []ConfigProblem {
+	messages := []string{err.Error()}
+	if type_err, ok := err.(*yaml.TypeError); ok {
+		messages = type_err.Errors
+	}
+
+	var problems []ConfigProblem
+	for _, message := range messages {
+		var problem ConfigProblem
+		message = strings.TrimPrefix(message, "yaml: ")
+		if match := yamlErrorLine.FindStringSubmatch(message); match != nil {
+			problem.Line, _ = strconv.Atoi(match[1])
+			message = match[2]
+		}
+		if match := yamlUnknownField.FindStringSubmatch(message); match != nil {
+			problem.Err = fmt.Errorf("%w %q", ErrUnknownConfigKey, match[1])
+		} else {
+			problem.Err = fmt.Errorf("%w: %s", ErrConfigSyntax, message)
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
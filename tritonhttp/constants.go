@@ -2,6 +2,8 @@ package tritonhttp
 
 import "time"
 
+// Timeouts of the client in Fetch. The timeouts of the server are set on
+// Server.
 const (
 	CONNECT_TIMEOUT time.Duration = 5 * time.Second
 	SEND_TIMEOUT    time.Duration = 5 * time.Second
@@ -0,0 +1,107 @@
+package tritonhttp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ETagMode selects how entity tags are generated for served files.
+type ETagMode int
+
+const (
+	// ETagWeak derives a weak tag from the file's modification time and
+	// size, e.g. W/"63e6a1b8-179". It is cheap but cannot tell apart two
+	// versions of a file with the same mtime and size.
+	ETagWeak ETagMode = iota
+
+	// ETagStrong derives a strong tag from a SHA-256 hash of the file's
+	// contents. The file is read in full to compute it on every request.
+	ETagStrong
+)
+
+// fileETag returns the entity tag of the file at filePath, including the
+// surrounding quotes and, for weak tags, the W/ prefix.
+func fileETag(filePath string, file_info os.FileInfo, mode ETagMode) (string, error) {
+	if mode != ETagStrong {
+		modtime := strconv.FormatInt(file_info.ModTime().Unix(), 16)
+		size := strconv.FormatInt(file_info.Size(), 16)
+		return `W/"` + modtime + "-" + size + `"`, nil
+	}
+
+	fp, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer fp.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, fp); err != nil {
+		return "", err
+	}
+	return `"` + hex.EncodeToString(hash.Sum(nil)) + `"`, nil
+}
+
+// parseETagList splits the value of an If-Match or If-None-Match header
+// into its entity tags. A lone "*" is returned as is. ok is false if the
+// value is malformed, in which case the header should be ignored.
+func parseETagList(value string) (tags []string, ok bool) {
+	value = strings.TrimSpace(value)
+	if value == "*" {
+		return []string{"*"}, true
+	}
+
+	for value != "" {
+		value = strings.TrimLeft(value, " \t")
+		if value == "" {
+			break
+		}
+		if value[0] == ',' {
+			value = value[1:]
+			continue
+		}
+
+		start := 0
+		if strings.HasPrefix(value, "W/") {
+			start = 2
+		}
+		if len(value) <= start || value[start] != '"' {
+			fmt.Println("Malformed entity tag list", value)
+			return nil, false
+		}
+		end := strings.IndexByte(value[start+1:], '"')
+		if end < 0 {
+			fmt.Println("Unterminated entity tag", value)
+			return nil, false
+		}
+		end += start + 2
+
+		tags = append(tags, value[:end])
+		value = value[end:]
+	}
+	return tags, len(tags) > 0
+}
+
+// etagMatch reports whether etag is in the list of tags from a
+// conditional header. The strong comparison (used by If-Match) only
+// matches identical strong tags, the weak comparison (used by
+// If-None-Match) ignores the W/ prefix on either side.
+func etagMatch(tags []string, etag string, strong bool) bool {
+	for _, tag := range tags {
+		if tag == "*" {
+			return true
+		}
+		if strong {
+			if !strings.HasPrefix(tag, "W/") && !strings.HasPrefix(etag, "W/") && tag == etag {
+				return true
+			}
+		} else if strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,429 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A Handler responds to a TritonHTTP request.
+//
+// ServeHTTP should set any response headers through w.Header(), pick a
+// status with w.WriteHeader and then write the response body to w.
+// Returning signals that the response is complete.
+type Handler interface {
+	ServeHTTP(w ResponseWriter, req *Request)
+}
+
+// HandlerFunc adapts an ordinary function to the Handler interface.
+type HandlerFunc func(w ResponseWriter, req *Request)
+
+// ServeHTTP calls f(w, req).
+func (f HandlerFunc) ServeHTTP(w ResponseWriter, req *Request) {
+	f(w, req)
+}
+
+// A ResponseWriter is used by a Handler to construct a response.
+type ResponseWriter interface {
+	// Header returns the header map that will be sent with the response.
+	// Changing the map after WriteHeader or Write has no effect.
+	Header() map[string]string
+
+	// WriteHeader sets the status code of the response. Only the first
+	// call has an effect.
+	WriteHeader(statusCode int)
+
+	// Write appends b to the response body, calling WriteHeader(200)
+	// first if no status has been set yet.
+	Write(b []byte) (int, error)
+}
+
+// A Flusher is a ResponseWriter that can send what the handler has
+// written so far to the client before the handler returns. The
+// ResponseWriter passed to handlers by Server implements Flusher.
+type Flusher interface {
+	Flush()
+}
+
+// responseBufferSize is how much of a handler's body is buffered before
+// the response starts streaming to the client.
+const responseBufferSize = 4096
+
+// responseWriter is the ResponseWriter handed to handlers by the server.
+//
+// Small bodies are recorded into res, which is then written out to the
+// connection with res.Write and framed with Content-Length. Once a body
+// outgrows responseBufferSize, or the handler calls Flush, the headers
+// are sent right away and the body is streamed with chunked transfer
+// coding instead, since its length is not known up front.
+type responseWriter struct {
+	res         *Response
+	conn        io.Writer
+	body        bytes.Buffer
+	wroteHeader bool
+
+	// set once the response is streaming
+	bw  *bufio.Writer
+	cw  *ChunkedWriter
+	out io.Writer
+
+	// trailer fields set before the head went out, which are held back
+	// from it for the trailer
+	early map[string]string
+}
+
+func (rw *responseWriter) Header() map[string]string {
+	return rw.res.Headers
+}
+
+func (rw *responseWriter) WriteHeader(statusCode int) {
+	if rw.wroteHeader {
+		fmt.Println("Superfluous WriteHeader call with status", statusCode)
+		return
+	}
+	rw.wroteHeader = true
+	rw.res.StatusCode = statusCode
+}
+
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(statusOK)
+	}
+	if rw.out == nil && rw.body.Len()+len(b) > responseBufferSize {
+		if err := rw.startStreaming(); err != nil {
+			return 0, err
+		}
+	}
+	if rw.out != nil {
+		return rw.out.Write(b)
+	}
+	return rw.body.Write(b)
+}
+
+func (rw *responseWriter) Flush() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(statusOK)
+	}
+	if rw.out == nil {
+		if err := rw.startStreaming(); err != nil {
+			fmt.Println("Error starting to stream response", err)
+			return
+		}
+	}
+	if err := rw.bw.Flush(); err != nil {
+		fmt.Println("Error flushing response", err)
+	}
+}
+
+// startStreaming sends the status line and headers and switches the body
+// from the buffer to the connection. Unless the handler set its own
+// Content-Length, the body is chunked.
+func (rw *responseWriter) startStreaming() error {
+	res := rw.res
+	rw.bw = bufio.NewWriter(rw.conn)
+
+	var body io.Writer = rw.bw
+	if !res.bodyAllowed() {
+		body = io.Discard
+	}
+	if _, ok := res.Headers["Content-Length"]; ok {
+		rw.out = body
+	} else {
+		res.Headers["Transfer-Encoding"] = "chunked"
+		rw.cw = NewChunkedWriter(body)
+		rw.out = rw.cw
+	}
+
+	for _, key := range rw.trailerKeys() {
+		if value, ok := res.Headers[key]; ok {
+			if rw.early == nil {
+				rw.early = make(map[string]string)
+			}
+			rw.early[key] = value
+			delete(res.Headers, key)
+		}
+	}
+
+	fmt.Println("Streaming response with headers", res.Headers)
+	if err := res.writeHead(rw.bw); err != nil {
+		return err
+	}
+	res.streamed = true
+
+	_, err := rw.out.Write(rw.body.Bytes())
+	rw.body.Reset()
+	return err
+}
+
+// trailerKeys returns the canonical keys declared in the "Trailer" header.
+func (rw *responseWriter) trailerKeys() []string {
+	declared, ok := rw.res.Headers["Trailer"]
+	if !ok {
+		return nil
+	}
+	var keys []string
+	for _, key := range strings.Split(declared, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, CanonicalHeaderKey(key))
+		}
+	}
+	return keys
+}
+
+// trailer returns the trailer fields declared in the "Trailer" header,
+// with the values the handler has set for them.
+func (rw *responseWriter) trailer() map[string]string {
+	trailer := make(map[string]string)
+	for _, key := range rw.trailerKeys() {
+		if value, ok := rw.res.Headers[key]; ok {
+			trailer[key] = value
+		} else if value, ok := rw.early[key]; ok {
+			trailer[key] = value
+		}
+	}
+	return trailer
+}
+
+// finish completes the response once the handler has returned. A
+// response that declares trailers is always streamed, since trailers
+// can only be sent after a chunked body.
+func (rw *responseWriter) finish() error {
+	if rw.res.FilePath != "" {
+		return nil
+	}
+	if rw.out == nil {
+		if _, ok := rw.res.Headers["Trailer"]; !ok {
+			rw.res.Body = rw.body.Bytes()
+			return nil
+		}
+		if err := rw.startStreaming(); err != nil {
+			return err
+		}
+	}
+	if rw.cw != nil {
+		rw.cw.Trailer = rw.trailer()
+		if err := rw.cw.Close(); err != nil {
+			return err
+		}
+	}
+	return rw.bw.Flush()
+}
+
+// serveFile makes the response stream the file at filePath using opts.
+func (rw *responseWriter) serveFile(filePath string, opts *FileOptions) {
+	if rw.out != nil {
+		fmt.Println("Cannot serve", filePath, "after the response started streaming")
+		return
+	}
+	rw.WriteHeader(statusOK)
+	rw.res.FilePath = filePath
+	rw.res.FileOptions = opts
+}
+
+// serveRequest runs handler for the request carried by res. Responses
+// the handler streamed are already written to conn when it returns and
+// have res.streamed set; everything else is stored back into res.
+func serveRequest(handler Handler, res *Response, conn io.Writer) error {
+	res.Headers = make(map[string]string)
+	rw := &responseWriter{res: res, conn: conn}
+
+	handler.ServeHTTP(rw, res.Request)
+
+	return rw.finish()
+}
+
+// ServeFile replies to the request with the contents of the named file,
+// or with a 404 if it is missing or a directory. The caller is
+// responsible for making sure filePath is safe to serve.
+func ServeFile(w ResponseWriter, req *Request, filePath string) {
+	serveFile(w, req, filePath, &FileOptions{})
+}
+
+func serveFile(w ResponseWriter, req *Request, filePath string, opts *FileOptions) {
+	if info, err := os.Stat(filePath); err != nil || info.IsDir() {
+		fmt.Println("Cannot serve", filePath, err)
+		w.WriteHeader(statusFileNotFound)
+		return
+	}
+
+	if rw, ok := w.(*responseWriter); ok {
+		rw.serveFile(filePath, opts)
+		return
+	}
+
+	// w is wrapped by some other ResponseWriter, so copy the file through it
+	fp, err := os.Open(filePath)
+	if err != nil {
+		fmt.Println("Error opening file in", getCurrentFunctionName(), err)
+		w.WriteHeader(statusFileNotFound)
+		return
+	}
+	defer fp.Close()
+	w.Header()["Content-Type"] = MIMETypeByExtension(path.Ext(filePath))
+	w.WriteHeader(statusOK)
+	if _, err := io.Copy(w, fp); err != nil {
+		fmt.Println("Error copying file in", getCurrentFunctionName(), err)
+	}
+}
+
+// FileOptions tunes how files are served. The zero value is ready to use.
+type FileOptions struct {
+	// ETag selects how the ETag header of served files is generated.
+	ETag ETagMode
+
+	// MaxRanges is the most ranges a single Range header may ask for;
+	// requests for more are answered with 416. 0 means defaultMaxRanges.
+	MaxRanges int
+
+	// DisableCompression turns off compressing files on the fly for
+	// clients that send Accept-Encoding.
+	DisableCompression bool
+
+	// CompressMinSize is the smallest file that gets compressed on the
+	// fly. 0 means defaultCompressMinSize.
+	CompressMinSize int64
+
+	// DisablePrecompressed stops serving precompressed siblings such as
+	// "index.html.gz" in place of "index.html".
+	DisablePrecompressed bool
+
+	// docRoot and symlinks, set for the files of a virtual host, keep
+	// precompressed siblings to what the host's SymlinkPolicy allows.
+	docRoot  string
+	symlinks SymlinkPolicy
+}
+
+func (opts *FileOptions) maxRanges() int {
+	if opts.MaxRanges <= 0 {
+		return defaultMaxRanges
+	}
+	return opts.MaxRanges
+}
+
+func (opts *FileOptions) compressMinSize() int64 {
+	if opts.CompressMinSize <= 0 {
+		return defaultCompressMinSize
+	}
+	return opts.CompressMinSize
+}
+
+// FileServer is a Handler that serves static files out of the docroot
+// of the virtual host named in the request's Host header.
+type FileServer struct {
+	// VirtualHosts maps a host name, alias or wildcard to its
+	// configuration; the key "*" holds the default host. Redirect and
+	// rewrite rules must be compiled.
+	VirtualHosts map[string]*VirtualHost
+
+	// FileOptions applies to every file served. The feature toggles of
+	// each VirtualHost are applied on top of it.
+	FileOptions
+}
+
+func (fs *FileServer) ServeHTTP(w ResponseWriter, req *Request) {
+	vhost := lookupVirtualHost(fs.VirtualHosts, req.Host)
+	if vhost == nil {
+		fmt.Println("No virtual host for host", req.Host)
+		w.WriteHeader(statusFileNotFound)
+		return
+	}
+
+	for key, value := range vhost.Headers {
+		w.Header()[key] = value
+	}
+
+	url_path, raw_query := req.Path, req.RawQuery
+
+	if location, status := vhost.redirect(url_path, raw_query); location != "" {
+		location = escapeLocation(location)
+		fmt.Println("Redirecting", url_path, "to", location)
+		w.Header()["Location"] = location
+		w.WriteHeader(status)
+		return
+	}
+	url_path, raw_query = vhost.rewrite(url_path, raw_query)
+
+	if req.Method != methodGet && req.Method != methodHead {
+		fmt.Println("Method", req.Method, "not allowed for static files")
+		w.Header()["Allow"] = "GET, HEAD"
+		serveError(w, vhost, statusMethodNotAllowed)
+		return
+	}
+
+	// Get doc root for specific host
+	doc_root := vhost.DocRoot
+	fmt.Println("Doc root for", req.Host, "is", doc_root)
+
+	file_path, status := validateURL(url_path, doc_root, vhost.indexFiles(), vhost.Symlinks)
+
+	if status == statusFileNotFound && vhost.AutoIndex && strings.HasSuffix(url_path, "/") {
+		// file_path names a missing index file, list its directory instead
+		dir_path, ok := resolvePath(doc_root, filepath.Dir(file_path), vhost.Symlinks)
+		if info, err := os.Stat(dir_path); ok && err == nil && info.IsDir() {
+			fmt.Println("Listing directory", dir_path)
+			serveDirListing(w, req, doc_root, vhost.Symlinks, dir_path, req.Path, raw_query)
+			return
+		}
+	}
+
+	if status == statusMovedPermanently {
+		// relative links in the directory's index resolve against the
+		// trailing slash; cleaning keeps "//host" out of the Location.
+		// The client is sent back to the path it asked for, not to the
+		// target of a rewrite, which the rewrite maps again.
+		location := (&url.URL{Path: path.Clean(req.Path) + "/"}).EscapedPath()
+		if req.RawQuery != "" {
+			location += "?" + req.RawQuery
+		}
+		fmt.Println("Redirecting to", location)
+		w.Header()["Location"] = location
+		w.WriteHeader(status)
+		return
+	}
+
+	if status != statusOK {
+		serveError(w, vhost, status)
+		return
+	}
+
+	serveFile(w, req, file_path, vhost.fileOptions(fs.FileOptions))
+}
+
+// serveError replies with status and the error page vhost configures for
+// it, if any.
+func serveError(w ResponseWriter, vhost *VirtualHost, status int) {
+	page, ok := vhost.ErrorPages[status]
+	if !ok {
+		w.WriteHeader(status)
+		return
+	}
+	page_path := filepath.Join(vhost.DocRoot, filepath.FromSlash(path.Clean("/"+page)))
+	body, err := os.ReadFile(page_path)
+	if err != nil {
+		fmt.Println("Error reading error page", page_path, err)
+		w.WriteHeader(status)
+		return
+	}
+	w.Header()["Content-Type"] = MIMETypeByExtension(path.Ext(page_path))
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// isWithinDir reports whether target is dir or lies below it.
+func isWithinDir(dir string, target string) bool {
+	abs_dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(abs_dir, target)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,102 @@
+package tritonhttp
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// normalizeHost validates the value of a Host header, or the authority
+// of an absolute-form request target, and returns the host it names
+// without the port: lower-cased and without a trailing dot for names,
+// and in canonical "[::1]" form for IPv6 literals. ok is false for
+// malformed values.
+func normalizeHost(value string) (host string, ok bool) {
+	host, port := value, ""
+	if strings.HasPrefix(value, "[") {
+		end := strings.IndexByte(value, ']')
+		if end < 0 {
+			fmt.Println("Unterminated IPv6 literal in host", value)
+			return "", false
+		}
+		host, port = value[:end+1], value[end+1:]
+		if port != "" && port[0] != ':' {
+			fmt.Println("Junk after IPv6 literal in host", value)
+			return "", false
+		}
+	} else if i := strings.LastIndexByte(value, ':'); i >= 0 {
+		host, port = value[:i], value[i:]
+	}
+
+	if port != "" && !validPort(port[1:]) {
+		fmt.Println("Invalid port in host", value)
+		return "", false
+	}
+
+	if strings.HasPrefix(host, "[") {
+		ip := net.ParseIP(host[1 : len(host)-1])
+		if ip == nil || (ip.To4() != nil && !strings.Contains(host, ":")) {
+			fmt.Println("Invalid IPv6 literal in host", value)
+			return "", false
+		}
+		return "[" + ip.String() + "]", true
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" || !validHostName(host) {
+		fmt.Println("Invalid host", value)
+		return "", false
+	}
+	return host, true
+}
+
+// validPort reports whether port, without its colon, is a valid port.
+// An empty port is allowed and means the default one.
+func validPort(port string) bool {
+	if port == "" {
+		return true
+	}
+	for _, c := range port {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	n, err := strconv.Atoi(port)
+	return err == nil && n <= 65535
+}
+
+// validHostName reports whether name only holds the characters allowed
+// in DNS names and IPv4 addresses.
+func validHostName(name string) bool {
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// splitAbsoluteURL splits an absolute-form request target such as
+// "http://website1:8080/index.html?a=1" into its authority and the
+// origin-form rest, which is "/" when the target has no path. ok is false
+// for targets that are not http or https URLs or carry user info.
+func splitAbsoluteURL(target string) (authority string, rest string, ok bool) {
+	scheme, after, found := strings.Cut(target, "://")
+	if !found || !strings.EqualFold(scheme, "http") && !strings.EqualFold(scheme, "https") {
+		return "", "", false
+	}
+	end := strings.IndexAny(after, "/?")
+	if end < 0 {
+		end = len(after)
+	}
+	authority, rest = after[:end], after[end:]
+	if strings.Contains(authority, "@") {
+		fmt.Println("User info in request target", target)
+		return "", "", false
+	}
+	if !strings.HasPrefix(rest, "/") {
+		rest = "/" + rest
+	}
+	return authority, rest, true
+}
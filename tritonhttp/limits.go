@@ -0,0 +1,92 @@
+package tritonhttp
+
+import (
+	"bufio"
+	"errors"
+	"strings"
+)
+
+// Request head limits used when the matching Server field is 0.
+const (
+	defaultMaxRequestLineBytes = 8 << 10
+	defaultMaxHeaderFieldBytes = 8 << 10
+	defaultMaxHeaderCount      = 100
+	defaultMaxHeaderBytes      = 64 << 10
+)
+
+var (
+	ErrRequestLineTooLong = errors.New("request line too long")
+	ErrHeaderTooLarge     = errors.New("header fields too large")
+)
+
+var errLineTooLong = errors.New("line too long")
+
+// headLimits bounds the parts of a request head. Zero fields mean the
+// defaults above.
+type headLimits struct {
+	requestLineBytes int
+	headerFieldBytes int
+	headerCount      int
+	headerBytes      int
+}
+
+// withDefaults returns l with its zero fields set to the defaults.
+func (l headLimits) withDefaults() headLimits {
+	if l.requestLineBytes == 0 {
+		l.requestLineBytes = defaultMaxRequestLineBytes
+	}
+	if l.headerFieldBytes == 0 {
+		l.headerFieldBytes = defaultMaxHeaderFieldBytes
+	}
+	if l.headerCount == 0 {
+		l.headerCount = defaultMaxHeaderCount
+	}
+	if l.headerBytes == 0 {
+		l.headerBytes = defaultMaxHeaderBytes
+	}
+	return l
+}
+
+// headLimits returns the request head limits of s.
+func (s *Server) headLimits() headLimits {
+	return headLimits{
+		requestLineBytes: s.MaxRequestLineBytes,
+		headerFieldBytes: s.MaxHeaderFieldBytes,
+		headerCount:      s.MaxHeaderCount,
+		headerBytes:      s.MaxHeaderBytes,
+	}.withDefaults()
+}
+
+// readLimitedLine reads a line ending in "\n" from br and returns it with
+// its line ending. Once the line, without its ending, grows past max
+// bytes it gives up with errLineTooLong, so memory use stays bounded.
+func readLimitedLine(br *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := br.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			// leave room for a "\r" that may still be followed by "\n"
+			if len(line) > max+1 {
+				return string(line), errLineTooLong
+			}
+			continue
+		}
+		if err == nil && len(strings.TrimRight(string(line), "\r\n")) > max {
+			return string(line), errLineTooLong
+		}
+		return string(line), err
+	}
+}
+
+// headLimitError returns the error rejecting a request head whose
+// request line, or else one of its header lines, is too long.
+func headLimitError(request_line bool, line string) error {
+	if len(line) > 64 {
+		line = line[:64] + "..."
+	}
+	if request_line {
+		return &ParseError{ErrRequestLineTooLong, line}
+	}
+	return &ParseError{ErrHeaderTooLarge, line}
+}
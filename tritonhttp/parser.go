@@ -0,0 +1,276 @@
+package tritonhttp
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+var (
+	ErrMalformedRequestLine = errors.New("malformed request line")
+	ErrInvalidTarget        = errors.New("invalid request target")
+	ErrUnsupportedMethod    = errors.New("method not implemented")
+	ErrUnsupportedVersion   = errors.New("HTTP version not supported")
+	ErrInvalidHeader        = errors.New("invalid header field")
+	ErrObsFold              = errors.New("obsolete line folding")
+	ErrBareLF               = errors.New("line not ending in CRLF")
+	ErrInvalidHost          = errors.New("missing, repeated or invalid Host header")
+)
+
+// ParseError is returned by Parser for a request head it rejects.
+type ParseError struct {
+	Err  error  // one of the Err* values of this package
+	Line string // the offending line
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%v: %q", e.Err, e.Line)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// StatusCode returns the status to reject the request with.
+func (e *ParseError) StatusCode() int {
+	switch e.Err {
+	case ErrUnsupportedMethod:
+		return statusNotImplemented
+	case ErrUnsupportedVersion:
+		return statusHTTPVersionNotSupported
+	case ErrRequestLineTooLong:
+		return statusURITooLong
+	case ErrHeaderTooLarge:
+		return statusHeaderFieldsTooLarge
+	}
+	return statusBadRequest
+}
+
+// errorStatus returns the status to reject a request with after err.
+func errorStatus(err error) int {
+	var parse_err *ParseError
+	if errors.As(err, &parse_err) {
+		return parse_err.StatusCode()
+	}
+	return statusBadRequest
+}
+
+// Parser parses request heads as RFC 7230 describes them. The zero value
+// is strict.
+type Parser struct {
+	// Lenient accepts lines ending in a bare LF and unfolds obsolete line
+	// folding, both of which are rejected with 400 otherwise.
+	Lenient bool
+}
+
+// Parse parses head, a request line followed by header fields and the
+// blank line that ends them. It returns a *ParseError for heads that are
+// malformed or use an unsupported method or version.
+func (p *Parser) Parse(head []byte) (*Request, error) {
+	lines, err := p.splitLines(string(head))
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return nil, &ParseError{ErrMalformedRequestLine, ""}
+	}
+
+	req := &Request{Headers: make(Header)}
+	if err := parseRequestLine(lines[0], req); err != nil {
+		return nil, err
+	}
+	if err := p.parseHeaders(lines[1:], req); err != nil {
+		return nil, err
+	}
+
+	hosts := req.Headers.Values("Host")
+	if len(hosts) != 1 {
+		return nil, &ParseError{ErrInvalidHost, strings.Join(hosts, ", ")}
+	}
+	host, ok := normalizeHost(hosts[0])
+	if !ok {
+		return nil, &ParseError{ErrInvalidHost, hosts[0]}
+	}
+	if req.Host == "" {
+		// an absolute-form target has set the host already
+		req.Host = host
+	}
+
+	req.Close = hasToken(req.Headers.Values("Connection"), "close")
+	return req, nil
+}
+
+// splitLines splits head into its lines, up to the blank line, and strips
+// their line endings.
+func (p *Parser) splitLines(head string) ([]string, error) {
+	var lines []string
+	for head != "" {
+		line, rest, found := strings.Cut(head, "\n")
+		if !found {
+			return nil, &ParseError{ErrMalformedRequestLine, line}
+		}
+		if strings.HasSuffix(line, "\r") {
+			line = line[:len(line)-1]
+		} else if !p.Lenient {
+			return nil, &ParseError{ErrBareLF, line}
+		}
+		if line == "" {
+			break
+		}
+		lines = append(lines, line)
+		head = rest
+	}
+	return lines, nil
+}
+
+// parseRequestLine parses "method SP request-target SP HTTP-version" into
+// req.
+func parseRequestLine(line string, req *Request) error {
+	parts := strings.Split(line, " ")
+	if len(parts) != 3 || !validToken(parts[0]) || parts[1] == "" || !validVersion(parts[2]) {
+		return &ParseError{ErrMalformedRequestLine, line}
+	}
+	method, target, proto := parts[0], parts[1], parts[2]
+
+	if proto != "HTTP/1.1" {
+		return &ParseError{ErrUnsupportedVersion, line}
+	}
+	if !supportedMethods[method] {
+		return &ParseError{ErrUnsupportedMethod, line}
+	}
+
+	if authority, rest, ok := splitAbsoluteURL(target); ok {
+		// the host of an absolute-form target overrides the Host header
+		host, ok := normalizeHost(authority)
+		if !ok {
+			return &ParseError{ErrInvalidHost, line}
+		}
+		req.Host = host
+		target = rest
+	}
+	// a fragment is never sent, and a '#' in a path must be encoded
+	if target[0] != '/' || !validFieldValue(target) || strings.Contains(target, "#") {
+		return &ParseError{ErrInvalidTarget, line}
+	}
+	if err := parseTarget(target, req); err != nil {
+		return &ParseError{ErrInvalidTarget, line}
+	}
+
+	req.Method = method
+	req.URL = target
+	req.Proto = proto
+	return nil
+}
+
+// parseTarget splits an origin-form target into the path and query fields
+// of req, decoding the path.
+func parseTarget(target string, req *Request) error {
+	raw_path, raw_query, _ := strings.Cut(target, "?")
+	decoded, err := url.PathUnescape(raw_path)
+	if err != nil {
+		return err
+	}
+	if strings.IndexByte(decoded, 0) >= 0 {
+		return errors.New("NUL byte in path")
+	}
+	query, err := url.ParseQuery(raw_query)
+	if err != nil {
+		// keep the pairs that did parse
+		fmt.Println("Ignoring invalid query", raw_query, err)
+	}
+
+	req.Path = decoded
+	req.RawPath = raw_path
+	req.RawQuery = raw_query
+	req.Query = query
+	return nil
+}
+
+// parseHeaders parses header field lines into req.Headers.
+func (p *Parser) parseHeaders(lines []string, req *Request) error {
+	var last string // key of the previous field, for obs-fold
+	for _, line := range lines {
+		if line[0] == ' ' || line[0] == '\t' {
+			if !p.Lenient || last == "" {
+				return &ParseError{ErrObsFold, line}
+			}
+			// replace the fold by a single space
+			values := req.Headers[last]
+			folded := strings.TrimRight(values[len(values)-1]+" "+trimOWS(line), " \t")
+			if !validFieldValue(folded) {
+				return &ParseError{ErrInvalidHeader, line}
+			}
+			values[len(values)-1] = folded
+			continue
+		}
+
+		// only the first ":" separates the key, values such as dates may contain more
+		key, value, found := strings.Cut(line, ":")
+		if !found || !validToken(key) {
+			return &ParseError{ErrInvalidHeader, line}
+		}
+		value = trimOWS(value)
+		if !validFieldValue(value) {
+			return &ParseError{ErrInvalidHeader, line}
+		}
+		last = CanonicalHeaderKey(key)
+		req.Headers.Add(last, value)
+	}
+	return nil
+}
+
+// trimOWS removes optional whitespace around a field value.
+func trimOWS(s string) string {
+	return strings.Trim(s, " \t")
+}
+
+// isTokenChar reports whether c may appear in a token, such as a method
+// or a header field name.
+func isTokenChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+// validToken reports whether s is a non-empty token.
+func validToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isTokenChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// validFieldValue reports whether s is free of control characters other
+// than horizontal tab. Bytes above 0x7f are allowed as obs-text.
+func validFieldValue(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c < ' ' && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// validVersion reports whether s has the form "HTTP/" DIGIT "." DIGIT.
+func validVersion(s string) bool {
+	return len(s) == 8 && strings.HasPrefix(s, "HTTP/") &&
+		'0' <= s[5] && s[5] <= '9' && s[6] == '.' && '0' <= s[7] && s[7] <= '9'
+}
+
+// hasToken reports whether the comma-separated lists in values contain
+// token, compared case-insensitively.
+func hasToken(values []string, token string) bool {
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if strings.EqualFold(trimOWS(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
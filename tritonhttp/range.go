@@ -0,0 +1,242 @@
+package tritonhttp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultMaxRanges is the number of ranges a Range header may ask for
+// when FileOptions.MaxRanges is 0.
+const defaultMaxRanges = 32
+
+// byteRange is a satisfiable range of bytes within a file.
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+// contentRange returns the value of the Content-Range header describing r
+// within a file of the given size.
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// mimeHeader returns the headers of the multipart/byteranges part for r.
+func (r byteRange) mimeHeader(contentType string, size int64) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {r.contentRange(size)},
+		"Content-Type":  {contentType},
+	}
+}
+
+var (
+	errInvalidRange = errors.New("invalid range")
+	errNoOverlap    = errors.New("range does not overlap the file")
+)
+
+// parseRange parses the value of a Range header against a file of the
+// given size. Ranges starting past the end of the file are dropped; if
+// none are left errNoOverlap is returned. errInvalidRange is returned
+// for syntactically invalid values, which the caller should ignore.
+func parseRange(value string, size int64) ([]byteRange, error) {
+	const unit = "bytes="
+	if !strings.HasPrefix(value, unit) {
+		return nil, errInvalidRange
+	}
+
+	var ranges []byteRange
+	noOverlap := false
+	for _, spec := range strings.Split(value[len(unit):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		dash := strings.IndexByte(spec, '-')
+		if dash < 0 {
+			return nil, errInvalidRange
+		}
+		first, last := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+		// positions are plain digits; ParseInt alone would take a sign
+		if first != "" && !isDigits(first) || last != "" && !isDigits(last) {
+			return nil, errInvalidRange
+		}
+
+		var r byteRange
+		if first == "" {
+			// suffix range "-N" selects the last N bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errInvalidRange
+			}
+			if n == 0 {
+				noOverlap = true
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r.start = size - n
+			r.length = n
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errInvalidRange
+			}
+			end := size - 1
+			if last != "" {
+				// an open-ended range "N-" runs to the end of the file
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, errInvalidRange
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			if start >= size {
+				noOverlap = true
+				continue
+			}
+			r.start = start
+			r.length = end - start + 1
+		}
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		if noOverlap {
+			return nil, errNoOverlap
+		}
+		return nil, errInvalidRange
+	}
+	return ranges, nil
+}
+
+// checkRange evaluates the Range and If-Range headers of res.Request for
+// a GET of the file described by file_info. It returns statusOK when the
+// whole file should be sent, statusPartialContent after storing the
+// selected range in res.ranges, or statusRangeNotSatisfiable.
+func (res *Response) checkRange(file_info os.FileInfo, etag string) int {
+	if res.Request == nil || res.Request.Method != methodGet {
+		return statusOK
+	}
+	value := res.Request.Headers.Get("Range")
+	if value == "" {
+		return statusOK
+	}
+
+	if if_range := res.Request.Headers.Get("If-Range"); if_range != "" && !checkIfRange(if_range, file_info, etag) {
+		fmt.Println("If-Range does not match, sending the full file")
+		return statusOK
+	}
+
+	ranges, err := parseRange(value, file_info.Size())
+	if err == errNoOverlap {
+		fmt.Println("Range not satisfiable", value)
+		return statusRangeNotSatisfiable
+	}
+	if err != nil {
+		fmt.Println("Ignoring Range header", value)
+		return statusOK
+	}
+
+	if len(ranges) > res.fileOptions().maxRanges() {
+		fmt.Println("Refusing", len(ranges), "ranges in a single request")
+		return statusRangeNotSatisfiable
+	}
+
+	res.ranges = coalesceRanges(ranges)
+	return statusPartialContent
+}
+
+// coalesceRanges sorts ranges by their start and merges the ones that
+// overlap or are adjacent, so that no byte is sent more than once.
+func coalesceRanges(ranges []byteRange) []byteRange {
+	sorted := make([]byteRange, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].start < sorted[j].start })
+
+	merged := sorted[:1]
+	for _, r := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if r.start <= last.start+last.length {
+			if end := r.start + r.length; end > last.start+last.length {
+				last.length = end - last.start
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// randomBoundary returns a fresh multipart boundary.
+func randomBoundary() string {
+	var buf [16]byte
+	if _, err := io.ReadFull(rand.Reader, buf[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter int64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
+
+// multipartLength returns the length of the multipart/byteranges body
+// that writeRanges produces for the same arguments.
+func multipartLength(ranges []byteRange, contentType string, size int64, boundary string) int64 {
+	var w countingWriter
+	mw := multipart.NewWriter(&w)
+	mw.SetBoundary(boundary)
+	for _, r := range ranges {
+		mw.CreatePart(r.mimeHeader(contentType, size))
+		w += countingWriter(r.length)
+	}
+	mw.Close()
+	return int64(w)
+}
+
+// writeRanges writes the given ranges of the file at filePath into w as a
+// multipart/byteranges body delimited by boundary.
+func writeRanges(w io.Writer, filePath string, ranges []byteRange, contentType string, size int64, boundary string) error {
+	mw := multipart.NewWriter(w)
+	mw.SetBoundary(boundary)
+	for _, r := range ranges {
+		part, err := mw.CreatePart(r.mimeHeader(contentType, size))
+		if err != nil {
+			return err
+		}
+		if err := writeFile(part, filePath, r.start, r.length); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// checkIfRange reports whether the validator in an If-Range header still
+// matches the file, in which case the Range header is honored. Only a
+// strong entity tag or an exact Last-Modified date can match.
+func checkIfRange(value string, file_info os.FileInfo, etag string) bool {
+	if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "W/") {
+		return etagMatch([]string{value}, etag, true)
+	}
+	t, err := ParseTime(value)
+	if err != nil {
+		return false
+	}
+	return truncateModTime(file_info.ModTime()).Equal(t)
+}
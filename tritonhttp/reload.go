@@ -0,0 +1,73 @@
+package tritonhttp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// SetVirtualHosts atomically replaces the virtual hosts of s with vh_map,
+// which must be ready to use, e.g. as returned by LoadConfig. Connections
+// accepted afterwards are served from vh_map, while open ones keep the
+// table they started with until they close.
+func (s *Server) SetVirtualHosts(vh_map map[string]*VirtualHost) {
+	s.vhosts.Store(&vh_map)
+}
+
+// virtualHosts returns the current virtual hosts of s.
+func (s *Server) virtualHosts() map[string]*VirtualHost {
+	if vh_map := s.vhosts.Load(); vh_map != nil {
+		return *vh_map
+	}
+	return s.VirtualHosts
+}
+
+// ReloadConfig loads the config file with LoadConfig and, if it has no
+// problems, makes it the virtual hosts of s. Otherwise s keeps serving
+// its current virtual hosts and the *ConfigError is returned.
+func (s *Server) ReloadConfig(vhConfigFilePath string, docroot_dirs_path string) error {
+	vh_map, err := LoadConfig(vhConfigFilePath, docroot_dirs_path)
+	if err != nil {
+		return err
+	}
+	s.SetVirtualHosts(vh_map)
+	return nil
+}
+
+// WatchConfig checks the config file every interval and calls
+// ReloadConfig when its modification time or size changed, until ctx
+// ends. A config with problems is reported and skipped until the file
+// changes again.
+func (s *Server) WatchConfig(ctx context.Context, vhConfigFilePath string, docroot_dirs_path string, interval time.Duration) {
+	last, err := os.Stat(vhConfigFilePath)
+	if err != nil {
+		fmt.Println("Error watching config", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(vhConfigFilePath)
+		if err != nil {
+			fmt.Println("Error watching config", err)
+			continue
+		}
+		if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+			continue
+		}
+		last = info
+
+		if err := s.ReloadConfig(vhConfigFilePath, docroot_dirs_path); err != nil {
+			fmt.Println("Keeping the current config:", err)
+			continue
+		}
+		fmt.Println("Reloaded config", vhConfigFilePath)
+	}
+}
@@ -1,13 +1,76 @@
 package tritonhttp
 
+import (
+	"io"
+	"net/url"
+	"strings"
+)
+
+// Header holds the header fields of a request, keyed in canonical form.
+// A field sent more than once keeps all its values, in order.
+type Header map[string][]string
+
+// Add appends value to the values of the field key.
+func (h Header) Add(key string, value string) {
+	key = CanonicalHeaderKey(key)
+	h[key] = append(h[key], value)
+}
+
+// Get returns the first value of the field key, or "" if it is absent.
+func (h Header) Get(key string) string {
+	if values := h[CanonicalHeaderKey(key)]; len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// Values returns all values of the field key.
+func (h Header) Values(key string) []string {
+	return h[CanonicalHeaderKey(key)]
+}
+
+// list returns the values of the list-valued field key joined into one
+// comma-separated list, as if they had been sent in a single field.
+func (h Header) list(key string) string {
+	return strings.Join(h.Values(key), ", ")
+}
+
 type Request struct {
 	Method string // e.g. "GET"
 	URL    string // e.g. "/path/to/a/file"
 	Proto  string // e.g. "HTTP/1.1"
 
+	// Path is the percent-decoded path of URL, e.g. "/my file.html" for
+	// "/my%20file.html?v=3", and RawPath the path as sent.
+	Path    string
+	RawPath string
+
+	// RawQuery is the query string of URL without the "?", e.g. "v=3",
+	// and Query its parsed values.
+	RawQuery string
+	Query    url.Values
+
 	// Headers stores the key-value HTTP headers
-	Headers map[string]string
+	Headers Header
+
+	// Host is the lower-cased host name of the "Host" header, or of an
+	// absolute-form request target, without the port. IPv6 literals keep
+	// their brackets, e.g. "[::1]".
+	Host string
+
+	Close bool // determine from the "Connection" header
+
+	// ContentLength is the length of Body as given by the "Content-Length"
+	// header, 0 if the request has no body, or -1 if the body is chunked.
+	ContentLength int64
+
+	// Body is the request body. It is bounded by ContentLength or decoded
+	// from chunks, and reads io.EOF right away for requests without a
+	// body. Whatever the handler leaves unread is discarded before the
+	// next request is read.
+	Body io.Reader
 
-	Host  string // determine from the "Host" header
-	Close bool   // determine from the "Connection" header
+	// Trailer holds the trailer fields sent after a chunked body. It is
+	// only complete once Body has returned io.EOF.
+	Trailer map[string]string
 }
@@ -16,4 +16,22 @@ type Response struct {
 	// FilePath is the local path to the file to serve.
 	// It could be "", which means there is no file to serve.
 	FilePath string
+
+	// FileOptions tunes how FilePath is served. nil means the defaults.
+	FileOptions *FileOptions
+
+	// Body is the payload written by a Handler that does not serve a file.
+	// It is only used when FilePath is "".
+	Body []byte
+
+	// ranges holds the byte range selected for a 206 response.
+	ranges []byteRange
+
+	// streamed is set once the response has been written to the
+	// connection by the handler's ResponseWriter.
+	streamed bool
+
+	// keepAlive is the Keep-Alive header sent if the connection is kept
+	// open after the response.
+	keepAlive string
 }
@@ -0,0 +1,176 @@
+package tritonhttp
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	matchExact  = "exact"
+	matchPrefix = "prefix"
+	matchRegex  = "regex"
+)
+
+// redirectStatuses are the statuses a redirect rule may answer with.
+var redirectStatuses = map[int]bool{
+	statusMovedPermanently:  true,
+	statusFound:             true,
+	statusTemporaryRedirect: true,
+	statusPermanentRedirect: true,
+}
+
+// Rule maps request paths matching From to the target To.
+type Rule struct {
+	// Match is how From is compared with the request path: "exact" (the
+	// default), "prefix" or "regex".
+	Match string `yaml:"match"`
+	From  string `yaml:"from"`
+	// To replaces the matched path. A prefix rule replaces only the
+	// prefix; a regex rule may refer to its captures as $1 or ${name}.
+	// A query string in To is merged with the one of the request.
+	To string `yaml:"to"`
+	// Status is the status of a redirect: 301 (the default), 302, 307 or
+	// 308. Rewrites ignore it.
+	Status int `yaml:"status"`
+
+	re *regexp.Regexp
+}
+
+// compile checks r and compiles its pattern. Rewrites stay on the server,
+// so their targets must be paths, while redirects may point anywhere.
+func (r *Rule) compile(redirect bool) error {
+	if r.From == "" {
+		return fmt.Errorf("rule to %q has no from", r.To)
+	}
+	switch r.Match {
+	case "":
+		r.Match = matchExact
+	case matchExact, matchPrefix:
+	case matchRegex:
+		re, err := regexp.Compile(r.From)
+		if err != nil {
+			return fmt.Errorf("rule from %q: %v", r.From, err)
+		}
+		r.re = re
+	default:
+		return fmt.Errorf("rule from %q: unknown match %q", r.From, r.Match)
+	}
+
+	if !redirect {
+		if !strings.HasPrefix(r.To, "/") {
+			return fmt.Errorf("rewrite from %q: target %q is not an absolute path", r.From, r.To)
+		}
+		return nil
+	}
+	if r.To == "" {
+		return fmt.Errorf("redirect from %q has no target", r.From)
+	}
+	if r.Status == 0 {
+		r.Status = statusMovedPermanently
+	}
+	if !redirectStatuses[r.Status] {
+		return fmt.Errorf("redirect from %q: unsupported status %d", r.From, r.Status)
+	}
+	return nil
+}
+
+// apply returns the target for url_path and whether r matched it.
+func (r *Rule) apply(url_path string) (string, bool) {
+	switch r.Match {
+	case matchExact:
+		if url_path == r.From {
+			return r.To, true
+		}
+	case matchPrefix:
+		if strings.HasPrefix(url_path, r.From) {
+			return r.To + url_path[len(r.From):], true
+		}
+	case matchRegex:
+		if r.re == nil {
+			fmt.Println("Skipping uncompiled rule from", r.From)
+			return "", false
+		}
+		if match := r.re.FindStringSubmatchIndex(url_path); match != nil {
+			return string(r.re.ExpandString(nil, r.To, url_path, match)), true
+		}
+	}
+	return "", false
+}
+
+// Rules are the redirect and rewrite rules of a virtual host. Both lists
+// are tried in order and the first matching rule wins.
+type Rules struct {
+	// Redirects send the client to another URL.
+	Redirects []Rule `yaml:"redirects"`
+	// Rewrites change the path looked up in the doc root without the
+	// client noticing.
+	Rewrites []Rule `yaml:"rewrites"`
+}
+
+// Compile checks every rule and compiles the regex patterns. It must be
+// called before the rules are used.
+func (rules *Rules) Compile() error {
+	for i := range rules.Redirects {
+		if err := rules.Redirects[i].compile(true); err != nil {
+			return err
+		}
+	}
+	for i := range rules.Rewrites {
+		if err := rules.Rewrites[i].compile(false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redirect returns the Location and status of the first redirect rule
+// matching url_path, or "" when the request is not redirected.
+func (rules *Rules) redirect(url_path string, raw_query string) (string, int) {
+	for i := range rules.Redirects {
+		if target, ok := rules.Redirects[i].apply(url_path); ok {
+			return joinQuery(target, raw_query), rules.Redirects[i].Status
+		}
+	}
+	return "", 0
+}
+
+// rewrite returns the path and query string to serve for the request,
+// which are url_path and raw_query unless a rewrite rule matches.
+func (rules *Rules) rewrite(url_path string, raw_query string) (string, string) {
+	for i := range rules.Rewrites {
+		if target, ok := rules.Rewrites[i].apply(url_path); ok {
+			fmt.Println("Rewrote", url_path, "to", target)
+			new_path, new_query, _ := strings.Cut(joinQuery(target, raw_query), "?")
+			return new_path, new_query
+		}
+	}
+	return url_path, raw_query
+}
+
+// joinQuery appends raw_query to target, after any query string target
+// already has.
+func joinQuery(target string, raw_query string) string {
+	if raw_query == "" {
+		return target
+	}
+	if strings.Contains(target, "?") {
+		return target + "&" + raw_query
+	}
+	return target + "?" + raw_query
+}
+
+// escapeLocation percent-encodes the bytes of a redirect target that may
+// not appear in a URL, such as spaces captured from a decoded path.
+func escapeLocation(location string) string {
+	var b strings.Builder
+	for i := 0; i < len(location); i++ {
+		c := location[i]
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("\"<>\\^`{|}", c) >= 0 {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
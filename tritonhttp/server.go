@@ -2,6 +2,7 @@ package tritonhttp
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -13,8 +14,9 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
-	"unicode"
 )
 
 type Server struct {
@@ -23,53 +25,232 @@ type Server struct {
 	// during ListenAndServe().
 	Addr string // e.g. ":0"
 
-	// VirtualHosts contains a mapping from host name to the docRoot path
-	// (i.e. the path to the directory to serve static files from) for
-	// all virtual hosts that this server supports
-	VirtualHosts map[string]string
+	// VirtualHosts contains a mapping from host name to the configuration
+	// (most importantly the docRoot, i.e. the path to the directory to
+	// serve static files from) for all virtual hosts that this server
+	// supports. Keys may be wildcards like "*.website1", and "*" holds
+	// the default host. It is the table the server starts with; use
+	// SetVirtualHosts to replace it while the server runs.
+	VirtualHosts map[string]*VirtualHost
+
+	// Parser parses the requests read from connections. If nil, a strict
+	// zero Parser is used.
+	Parser *Parser
+
+	// Handler is invoked for every valid request. If nil, a FileServer
+	// serving VirtualHosts is used.
+	Handler Handler
+
+	// MaxBodyBytes limits the Content-Length of request bodies; larger
+	// requests get a 413 response. 0 means defaultMaxBodyBytes.
+	MaxBodyBytes int64
+
+	// MaxRequestLineBytes limits the length of the request line; longer
+	// ones get a 414 response. 0 means defaultMaxRequestLineBytes.
+	MaxRequestLineBytes int
+
+	// MaxHeaderFieldBytes limits the length of a single header line, and
+	// MaxHeaderCount and MaxHeaderBytes the number of header fields and
+	// the size of the header section. Requests exceeding any of them get
+	// a 431 response. 0 means the matching default in limits.go.
+	MaxHeaderFieldBytes int
+	MaxHeaderCount      int
+	MaxHeaderBytes      int
+
+	// ReadHeaderTimeout limits the time to read a request head once its
+	// first byte has arrived; a partial head then gets a 400 response.
+	// 0 means defaultReadHeaderTimeout.
+	ReadHeaderTimeout time.Duration
+
+	// ReadTimeout limits the time to read a request body, and
+	// WriteTimeout the time to write a response, both from the end of the
+	// request head. A ReadTimeout of 0 leaves the deadline of the head in
+	// force, so the body must arrive within ReadHeaderTimeout of the first
+	// byte of the request. A WriteTimeout of 0 means no limit.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// IdleTimeout limits the wait for the next request on a connection,
+	// which is closed when it expires. 0 means defaultIdleTimeout.
+	// Responses on connections kept open advertise it, and the requests
+	// left, in a Keep-Alive header.
+	IdleTimeout time.Duration
+
+	// MaxRequestsPerConn is the most requests served on a connection; the
+	// response to the last one carries "Connection: close". 0 means no
+	// limit.
+	MaxRequestsPerConn int
+
+	// mu guards listeners and conns, which Shutdown and Close close, and
+	// listenerAddr.
+	mu           sync.Mutex
+	listeners    map[net.Listener]struct{}
+	listenerAddr net.Addr
+	conns        map[net.Conn]connState
+	inShutdown   atomic.Bool
+
+	// vhosts replaces VirtualHosts once SetVirtualHosts is called.
+	vhosts atomic.Pointer[map[string]*VirtualHost]
 }
 
 const (
-	Proto          = "tcp"
-	Host           = "localhost"
-	Port           = "8080"
-	MaxMessageSize = 101
-	MaxRetries     = 3
+	Proto = "tcp"
+	Host  = "localhost"
+	Port  = "8080"
+)
+
+// rejectLingerTimeout and rejectLingerBytes bound how long and how much
+// of a rejected request closeAfterReject drains.
+const (
+	rejectLingerTimeout = 500 * time.Millisecond
+	rejectLingerBytes   = 256 << 10
 )
 
 const (
 	responseProto = "HTTP/1.1"
 
-	statusOK           = 200
-	statusFileNotFound = 404
-	statusBadRequest   = 400
+	statusOK                      = 200
+	statusCreated                 = 201
+	statusNoContent               = 204
+	statusPartialContent          = 206
+	statusMultipleChoices         = 300
+	statusMovedPermanently        = 301
+	statusFound                   = 302
+	statusSeeOther                = 303
+	statusNotModified             = 304
+	statusTemporaryRedirect       = 307
+	statusPermanentRedirect       = 308
+	statusFileNotFound            = 404
+	statusBadRequest              = 400
+	statusForbidden               = 403
+	statusMethodNotAllowed        = 405
+	statusLengthRequired          = 411
+	statusPreconditionFailed      = 412
+	statusPayloadTooLarge         = 413
+	statusURITooLong              = 414
+	statusRangeNotSatisfiable     = 416
+	statusHeaderFieldsTooLarge    = 431
+	statusInternalServerError     = 500
+	statusNotImplemented          = 501
+	statusServiceUnavailable      = 503
+	statusHTTPVersionNotSupported = 505
 )
 
+const (
+	methodGet  = "GET"
+	methodHead = "HEAD"
+	methodPost = "POST"
+	methodPut  = "PUT"
+)
+
+var supportedMethods = map[string]bool{
+	methodGet:  true,
+	methodHead: true,
+	methodPost: true,
+	methodPut:  true,
+}
+
 var statusText = map[int]string{
-	statusOK:           "OK",
-	statusFileNotFound: "Not Found",
-	statusBadRequest:   "Bad Request",
+	statusOK:                      "OK",
+	statusCreated:                 "Created",
+	statusNoContent:               "No Content",
+	statusPartialContent:          "Partial Content",
+	statusMultipleChoices:         "Multiple Choices",
+	statusMovedPermanently:        "Moved Permanently",
+	statusFound:                   "Found",
+	statusSeeOther:                "See Other",
+	statusNotModified:             "Not Modified",
+	statusTemporaryRedirect:       "Temporary Redirect",
+	statusPermanentRedirect:       "Permanent Redirect",
+	statusFileNotFound:            "Not Found",
+	statusBadRequest:              "Bad Request",
+	statusForbidden:               "Forbidden",
+	statusMethodNotAllowed:        "Method Not Allowed",
+	statusLengthRequired:          "Length Required",
+	statusPreconditionFailed:      "Precondition Failed",
+	statusPayloadTooLarge:         "Payload Too Large",
+	statusURITooLong:              "URI Too Long",
+	statusRangeNotSatisfiable:     "Range Not Satisfiable",
+	statusHeaderFieldsTooLarge:    "Request Header Fields Too Large",
+	statusInternalServerError:     "Internal Server Error",
+	statusNotImplemented:          "Not Implemented",
+	statusServiceUnavailable:      "Service Unavailable",
+	statusHTTPVersionNotSupported: "HTTP Version Not Supported",
+}
+
+// statusClassText is the reason phrase of codes missing from statusText,
+// by their first digit.
+var statusClassText = map[int]string{
+	1: "Informational",
+	2: "Success",
+	3: "Redirection",
+	4: "Client Error",
+	5: "Server Error",
 }
 
-func listenForClientConnections(address string, hosts map[string]string) {
+// reasonPhrase returns the reason phrase sent with code.
+func reasonPhrase(code int) string {
+	if text, ok := statusText[code]; ok {
+		return text
+	}
+	if text, ok := statusClassText[code/100]; ok {
+		return text
+	}
+	return "Unknown"
+}
 
-	fmt.Println("Starting " + Proto + " server on " + address)
-	listener, err := net.Listen(Proto, address)
-	if err != nil {
-		fmt.Println("listen error")
-		return
+// ErrServerClosed is returned by ListenAndServe and Serve once Shutdown or
+// Close has been called.
+var ErrServerClosed = errors.New("server closed")
+
+// acceptRetryMin and acceptRetryMax bound the back-off between attempts
+// to accept after an error, such as running out of file descriptors.
+const (
+	acceptRetryMin = 5 * time.Millisecond
+	acceptRetryMax = time.Second
+)
+
+// Serve accepts connections on listener and handles requests on each of
+// them in its own goroutine. It closes listener when it returns, and
+// always returns a non-nil error: ErrServerClosed after Shutdown or Close,
+// or the error that made listener stop accepting.
+func (s *Server) Serve(listener net.Listener) error {
+	if !s.trackListener(listener) {
+		listener.Close()
+		return ErrServerClosed
 	}
+	defer s.forgetListener(listener)
 	defer listener.Close()
 
+	fmt.Println("Starting " + Proto + " server on " + listener.Addr().String())
+	var retry_delay time.Duration
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
-			fmt.Println(("accept error"))
-			//os.Exit(1)
+			if s.shuttingDown() {
+				fmt.Println("Stopped accepting connections on", listener.Addr())
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			if retry_delay = 2 * retry_delay; retry_delay == 0 {
+				retry_delay = acceptRetryMin
+			} else if retry_delay > acceptRetryMax {
+				retry_delay = acceptRetryMax
+			}
+			fmt.Println("accept error, retrying in", retry_delay, err)
+			time.Sleep(retry_delay)
 			continue
 		}
+		retry_delay = 0
 		fmt.Println("Creating a goroutine to service new request from ", conn.RemoteAddr().String())
-		go handleClientConnection(conn, hosts)
+		if !s.trackConn(conn) {
+			// Shutdown or Close ran since Accept returned
+			conn.Close()
+			continue
+		}
+		go s.handleClientConnection(conn, s.Handler)
 	}
 }
 
@@ -82,24 +263,57 @@ func listenForClientConnections(address string, hosts map[string]string) {
 // 	return fields[0], nil
 // }
 
-func handleClientConnection(conn net.Conn, hosts_config map[string]string) {
+// handleClientConnection serves the requests sent on conn with handler,
+// or with a FileServer if handler is nil. The virtual hosts are looked up
+// once, so a connection keeps them if they are replaced meanwhile.
+func (s *Server) handleClientConnection(conn net.Conn, handler Handler) {
+	vh_map := s.virtualHosts()
+	if handler == nil {
+		handler = &FileServer{VirtualHosts: vh_map}
+	}
 
 	//defer conn.Close() Do not defer because it is persistenet connections
+	defer s.forgetConn(conn)
 	start := time.Now()
 	br := bufio.NewReader(conn)
+	// the host of a request is only known once its head is read, so the
+	// wait for the next one uses the timeouts of the previous host
+	timeouts := s.timeouts(nil)
+	requests := 0
 	for {
 		//fmt.Println("coming in for loop")
 		// Set timeout
 		start := time.Now()
 		fmt.Println("*************BEGIN*************")
-		if err := conn.SetReadDeadline(time.Now().Add(4 * time.Second)); err != nil {
+		if requests > 0 {
+			s.setConnState(conn, connIdle)
+		}
+		if err := setReadTimeout(conn, timeouts.idle); err != nil {
+			fmt.Println("Failed to set timeout for connection", conn)
+			_ = conn.Close()
+			break
+		}
+
+		// Wait for the next request to start
+		if _, err := br.Peek(1); err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				log.Printf("Idle connection to %v timed out", conn.RemoteAddr())
+			} else {
+				fmt.Println("Connection closed by", conn.RemoteAddr(), err)
+			}
+			_ = conn.Close()
+			fmt.Println("**************END**************")
+			break
+		}
+		s.setConnState(conn, connActive)
+		if err := setReadTimeout(conn, timeouts.readHeader); err != nil {
 			fmt.Println("Failed to set timeout for connection", conn)
 			_ = conn.Close()
 			break
 		}
 
 		// Read next request from the client
-		response, err, empty := ReadRequest(br, hosts_config)
+		response, err, empty := readRequest(br, s.parser(), s.headLimits())
 
 		if err == io.EOF {
 			fmt.Println("Connection closed by", conn.RemoteAddr())
@@ -125,8 +339,52 @@ func handleClientConnection(conn net.Conn, hosts_config map[string]string) {
 			break
 		}
 
+		if err != nil {
+			// e.g. the connection was closed by Close
+			fmt.Println("Error reading request from", conn.RemoteAddr(), err)
+			_ = conn.Close()
+			break
+		}
+
+		var vhost *VirtualHost
+		if response.Request != nil {
+			vhost = lookupVirtualHost(vh_map, response.Request.Host)
+		}
+		timeouts = s.timeouts(vhost)
+		setRequestDeadlines(conn, timeouts)
+
+		requests++
+		if response.Request != nil {
+			if timeouts.lastRequest(requests) {
+				fmt.Println("Closing connection after", requests, "requests")
+				response.Request.Close = true
+			}
+			response.keepAlive = timeouts.keepAlive(requests)
+		}
+
+		// whether input the connection cannot skip is left unread
+		body_unread := false
+		if response.StatusCode == statusOK && response.Request != nil {
+			if status := setupBody(br, response.Request, s.maxBodyBytes()); status != statusOK {
+				response.HandleError(status)
+				body_unread = true
+			}
+		}
+
+		if response.StatusCode == statusOK && response.Request != nil {
+			if err := serveRequest(handler, &response, conn); err != nil {
+				fmt.Println("error occured streaming response into connection:", err)
+				response.Request.Close = true
+			}
+		}
+
 		fmt.Println("Response ", response)
 
+		if response.Request != nil && s.shuttingDown() {
+			// this is the last response, tell the client not to send more
+			response.Request.Close = true
+		}
+
 		if response.Request != nil && response.Request.Close {
 			fmt.Println("Adding close header in Response")
 			if response.Headers != nil {
@@ -134,9 +392,31 @@ func handleClientConnection(conn net.Conn, hosts_config map[string]string) {
 			}
 		}
 
-		err = response.Write(conn)
-		if err != nil {
-			fmt.Println("error occured writing response into connection buffer:", err)
+		if !response.streamed {
+			err = response.Write(conn)
+			if err != nil {
+				// part of the response may be out, so nothing can follow it
+				fmt.Println("error occured writing response into connection buffer:", err)
+				if response.Request != nil {
+					response.Request.Close = true
+				}
+			}
+		}
+
+		if response.Request != nil && !response.Request.Close {
+			if err := discardBody(response.Request); err != nil {
+				fmt.Println("Error discarding request body", err)
+				response.Request.Close = true
+				body_unread = true
+			}
+		}
+
+		if response.Request == nil || body_unread {
+			// the rest of a rejected request cannot be told apart from the next one
+			fmt.Println("Closing connection after a bad request")
+			closeAfterReject(conn, br)
+			fmt.Println("**************END**************")
+			break
 		}
 
 		if response.Request != nil && response.Request.Close {
@@ -157,48 +437,110 @@ func handleClientConnection(conn net.Conn, hosts_config map[string]string) {
 
 }
 
+// closeAfterReject closes conn after the response to a rejected request.
+// Closing a socket with unread input makes the kernel reset the
+// connection, which can destroy the response before the client has read
+// it, so the write side is shut first and the input drained for a moment.
+func closeAfterReject(conn net.Conn, br *bufio.Reader) {
+	if tcp_conn, ok := conn.(*net.TCPConn); ok {
+		tcp_conn.CloseWrite()
+	}
+	conn.SetReadDeadline(time.Now().Add(rejectLingerTimeout))
+	io.CopyN(io.Discard, br, rejectLingerBytes)
+	conn.Close()
+}
+
+// ReadRequest2 reads a request head from br: the request line and header
+// fields up to and including the blank line that ends them, with their
+// line endings. Blank lines before the request line are skipped. When
+// an error occurs, whatever was read of the head is returned with it.
+// Heads exceeding the default limits fail with a *ParseError.
 func ReadRequest2(br *bufio.Reader) (req string, err error) {
+	return readRequestHead(br, headLimits{}.withDefaults())
+}
+
+// readRequestHead is ReadRequest2 with the given limits. It stops reading
+// as soon as a limit is exceeded.
+func readRequestHead(br *bufio.Reader, limits headLimits) (req string, err error) {
 
 	var full_request string
+	header_count, header_bytes := 0, 0
 	for {
-		line, err := ReadLine(br)
+		max_line := limits.headerFieldBytes
+		if full_request == "" {
+			max_line = limits.requestLineBytes
+		}
+		line, err := readLimitedLine(br, max_line)
+		if err == errLineTooLong {
+			fmt.Println("Line longer than", max_line, "bytes in request head")
+			return full_request + line, headLimitError(full_request == "", line)
+		}
 		if err != nil {
 			fmt.Println("Error reading line in ", getCurrentFunctionName(), err)
-			if line == "" && err != io.EOF {
-				//line is empty but still it is error since there is no complete request formed
-				fmt.Println("line is empty but still it is error since there is no complete request formed")
-				line = full_request
-			}
-			return line, err
+			return full_request + line, err
 		}
-		if line == "" {
+		if line == "\r\n" || line == "\n" {
+			if full_request == "" {
+				// a client may send an extra CRLF after a request body
+				continue
+			}
 			// This marks header end
 			fmt.Println("Encountered empty line")
-			break
+			return full_request + line, nil
 		}
-		full_request += (line + "\r\n")
+		if full_request != "" {
+			header_count++
+			header_bytes += len(line)
+			if header_count > limits.headerCount || header_bytes > limits.headerBytes {
+				fmt.Println("Header section exceeds", limits.headerCount, "fields or", limits.headerBytes, "bytes")
+				return full_request + line, headLimitError(false, line)
+			}
+		}
+		full_request += line
 		fmt.Println("Read line from request", line)
 	}
-
-	//fmt.Println("Full request from ", getCurrentFunctionName(), "\n", full_request)
-
-	return full_request, err
 }
 
 // returns if the buffer was empty when error occured
-func ReadRequest(br *bufio.Reader, hosts_config map[string]string) (resp Response, err error, empty bool) {
+func ReadRequest(br *bufio.Reader) (resp Response, err error, empty bool) {
+	return readRequest(br, &Parser{}, headLimits{}.withDefaults())
+}
+
+// readRequest reads the next request from br and parses it with parser.
+// A request the parser rejects is returned as a Response with the error
+// status and no Request.
+func readRequest(br *bufio.Reader, parser *Parser, limits headLimits) (resp Response, err error, empty bool) {
 	var response Response
 
-	full_request, err := ReadRequest2(br) // when error occurs ReadRequest2 returns only the last read line
+	full_request, err := readRequestHead(br, limits)
+
+	var parse_err *ParseError
+	if errors.As(err, &parse_err) {
+		fmt.Println("Rejecting request head", parse_err)
+		response.HandleError(parse_err.StatusCode())
+		return response, nil, false
+	}
 
 	if err != nil {
 		fmt.Println("Last line(s) that was read when error occured is", full_request, "end")
 		return response, err, full_request == ""
 	}
 
-	response = parseRequest([]byte(full_request), hosts_config)
+	fmt.Println("Full request is \n", full_request)
+
+	response.Proto = responseProto
+	response.StatusCode = statusOK
+
+	request, err := parser.Parse([]byte(full_request))
+	if err != nil {
+		fmt.Println("Error parsing request", err)
+		response.HandleError(errorStatus(err))
+		return response, nil, false
+	}
+	fmt.Println("Req headers are", request.Headers)
+	response.Request = request
 
-	return response, err, false
+	return response, nil, false
 }
 
 // HandleBadRequest prepares res to be a 405 Method Not allowed response
@@ -209,6 +551,18 @@ func (res *Response) HandleBadRequest() {
 	res.FilePath = ""
 }
 
+// HandleError prepares res to be an empty response with the given status.
+func (res *Response) HandleError(statusCode int) {
+	if statusCode == statusBadRequest {
+		res.HandleBadRequest()
+		return
+	}
+	fmt.Println("Handle error", statusCode)
+	res.Proto = responseProto
+	res.StatusCode = statusCode
+	res.FilePath = ""
+}
+
 func (res *Response) HandleFileNotFound() {
 	fmt.Println("Handle file not found")
 	res.Proto = responseProto
@@ -216,174 +570,11 @@ func (res *Response) HandleFileNotFound() {
 	res.FilePath = ""
 }
 
-func parseRequest(requestBytes []byte, hosts_config map[string]string) Response {
-
-	var response Response
-
-	response.Proto = responseProto
-	response.StatusCode = statusOK
-
-	converted_req := string(requestBytes)
-	fmt.Println("Full request is \n", converted_req)
-
-	arr_lines := strings.Split(converted_req, "\r\n")
-	//Removing 2 lines created by last delimiter
-
-	num_lines := len(arr_lines)
-
-	fmt.Println("Number of arr_lines ", len(arr_lines))
-	if num_lines == 0 || (num_lines == 1 && arr_lines[0] == "") {
-		response.HandleBadRequest()
-		return response
-	}
-
-	arr_lines = arr_lines[0 : len(arr_lines)-1] // there is one empty line after splitting by delimiter
-
-	if len(arr_lines) == 0 { //There should be at least one line
-		fmt.Println("No headers present")
-		response.HandleBadRequest()
-		return response
-	}
-
-	var request Request
-
-	fmt.Println("Number of headers are ", len(arr_lines))
-
-	status_code := validateHeaders(arr_lines, &request, &response)
-
-	if status_code == statusBadRequest {
-		fmt.Println("Bad request from validate headers")
-		response.HandleBadRequest()
-		return response
-	}
-
-	host := request.Host
-	response.Request.Host = host
-
-	checkFirstLineValid(arr_lines[0], &response, host, hosts_config)
-
-	return response
-
-}
-
-func validateHeaders(allLines []string, request *Request, response *Response) (StatusCode int) {
-
-	allLines = getHeaderLines(allLines)
-
-	req_headers := make(map[string]string)
-
-	for _, line := range allLines {
-		fmt.Println("---Checking for header---\n", line)
-		//line should contain ":"
-		if !strings.Contains(line, ":") {
-			fmt.Println("Missing :")
-			return statusBadRequest
-		}
-
-		line_split := strings.Split(line, ":")
-		if len(line_split) > 2 {
-			fmt.Println("More than 2 items in header split")
-			return statusBadRequest
-		}
-
-		key := line_split[0]
-		value := line_split[1]
-
-		//Validate key
-		is_valid_key := isAlphaNumHyphen(key)
-
-		if !is_valid_key {
-			return statusBadRequest
-		}
-
-		// Trimming value
-		value = strings.Trim(value, " ")
-
-		// Converting key to canonical form
-		key = strings.ToLower(key)
-		key = strings.Replace(key, "-", " ", -1)
-		key = strings.Title(key)
-		key = strings.Replace(key, " ", "-", -1)
-
-		if key == "Host" {
-			request.Host = value
-		}
-		if key == "Connection" {
-			fmt.Println("Connection close header is present in the request")
-			request.Close = (value == "close" || value == "Close")
-		}
-
-		req_headers[key] = value
-		fmt.Println("---End of line--")
-	}
-
-	if request.Host == "" {
-		fmt.Println("Host missing in headers")
-		return statusBadRequest
-	}
-
-	request.Headers = req_headers
-	request.Method = "GET"
-	response.Request = request // Assigning request object in response
-
-	fmt.Println("Req headers are", req_headers)
-
-	return statusOK
-}
-
-func isAlphaNumHyphen(str string) bool {
-	for _, c := range str {
-		if !(unicode.IsLetter(c) || unicode.IsDigit(c) || c == '-') {
-			fmt.Println("Invalid key", str)
-			return false
-		}
-	}
-	//fmt.Println("Valid key", str)
-	return true
-}
-
-func checkFirstLineValid(line string, response *Response, host string, hosts map[string]string) {
-
-	// Checking for validity of number of spaces
-	arr := strings.Split(line, " ")
-
-	if len(arr) != 3 || (arr[0] != "GET") {
-		fmt.Println("First line invalid")
-		response.HandleBadRequest()
-		return
-	}
-
-	if arr[2] != "HTTP/1.1" {
-		fmt.Println("First line invalid protocol")
-		response.HandleBadRequest()
-		return
-	}
-
-	// Checking for validity of URL
-
-	url := arr[1]
-	if url[0] != '/' {
-		fmt.Println("Url not starting with /")
-		response.HandleBadRequest()
-		return
-	}
-	// Get doc root for specific host
-	doc_root, exists := hosts[host]
-
-	if !exists {
-		response.HandleFileNotFound()
-	}
-
-	fmt.Println("Doc root for", host, "is", doc_root)
-
-	file_path, status := validateURL(url, doc_root)
-	response.FilePath = file_path
-	response.StatusCode = status
-
-}
-
-func validateURL(url string, doc_root string) (cleaned_url string, status int) {
-	index_file := "index.html"
+// validateURL maps url, a decoded path, to a file under doc_root that
+// symlinks allows to be served. It returns statusMovedPermanently when url
+// names a directory but lacks the trailing slash, so the caller can
+// redirect the client to it.
+func validateURL(url string, doc_root string, index_files []string, symlinks SymlinkPolicy) (cleaned_url string, status int) {
 
 	abs_path, err := filepath.Abs(doc_root)
 
@@ -391,23 +582,25 @@ func validateURL(url string, doc_root string) (cleaned_url string, status int) {
 		fmt.Println("Error getting absolute path", err)
 		return
 	}
-	if url[len(url)-1] == '/' {
-		url += index_file
+	dir_request := url[len(url)-1] == '/'
+	// resolve "." and "..", which may have been sent encoded as "%2e%2e",
+	// against the root so that they cannot climb out of the doc root
+	url = path.Clean("/" + url)
+	if dir_request {
+		url = strings.TrimSuffix(url, "/") + "/"
+		url += findIndexFile(filepath.Join(abs_path, url), index_files)
 	}
 
-	combined_path := abs_path + url
-	fmt.Println("Absolute path is", abs_path, "\nCombined path is ", combined_path)
-
-	file_path := filepath.Clean(abs_path + url)
+	file_path := filepath.Join(abs_path, url)
 
 	fmt.Println("The cleaned filepath is ", file_path)
 
-	if file_path[:len(abs_path)] != abs_path {
-		fmt.Println("Referencing out of root directory")
+	file_path, ok := resolvePath(abs_path, file_path, symlinks)
+	if !ok {
 		return file_path, statusFileNotFound
 	}
 
-	_, err = os.Stat(file_path)
+	file_info, err := os.Stat(file_path)
 	// if os.IsNotExist(err) {
 	// 	// file does not exist
 	// 	fmt.Println("File does not exist")
@@ -419,99 +612,179 @@ func validateURL(url string, doc_root string) (cleaned_url string, status int) {
 		return file_path, statusFileNotFound
 	}
 
+	if file_info.IsDir() {
+		if dir_request {
+			fmt.Println("Index file is a directory")
+			return file_path, statusFileNotFound
+		}
+		fmt.Println("Requested path is a directory")
+		return file_path, statusMovedPermanently
+	}
+
 	return file_path, statusOK
 
 }
 
-func getHeaderLines(allLines []string) []string {
-	header_lines := allLines[1:]
-	return header_lines
+// findIndexFile returns the first of index_files that exists in the
+// directory dir_path, or the first one if none does.
+func findIndexFile(dir_path string, index_files []string) string {
+	for _, index_file := range index_files {
+		if _, err := os.Stat(filepath.Join(dir_path, index_file)); err == nil {
+			return index_file
+		}
+	}
+	return index_files[0]
 }
 
 // ListenAndServe listens on the TCP network address s.Addr and then
-// handles requests on incoming connections.
+// calls Serve to handle requests on incoming connections. It returns the
+// error of net.Listen if the address cannot be listened on, and otherwise
+// what Serve returns.
 func (s *Server) ListenAndServe() error {
 
 	// Hint: Validate all docRoots
 
-	// Hint: create your listen socket and spawn off goroutines per incoming client
-	listenForClientConnections(s.Addr, s.VirtualHosts)
+	if s.shuttingDown() {
+		return ErrServerClosed
+	}
+	listener, err := net.Listen(Proto, s.Addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
 
-	return nil
+}
 
+// ListenerAddr returns the address the server is listening on, which
+// holds the port picked for an Addr such as ":0", or nil if it is not
+// listening yet. With several listeners it is the one of the latest.
+func (s *Server) ListenerAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listenerAddr
 }
 
 func (res *Response) Write(w io.Writer) error {
 	bw := bufio.NewWriter(w)
 
-	statusLine := fmt.Sprintf("%v %v %v\r\n", res.Proto, res.StatusCode, statusText[res.StatusCode])
-	if _, err := bw.WriteString(statusLine); err != nil {
-		fmt.Println("Error in writing status line into connection")
-		return err
+	var file_info os.FileInfo
+	if res.StatusCode == statusOK && res.FilePath != "" {
+		var err error
+		file_info, err = os.Stat(res.FilePath)
+		fmt.Println("File path being accessed", res.FilePath)
+		if err != nil {
+			// the file went away after the handler chose it
+			fmt.Println("Error accessing file", err)
+			file_info = nil
+			if os.IsNotExist(err) {
+				res.HandleError(statusFileNotFound)
+			} else {
+				res.HandleError(statusInternalServerError)
+			}
+		}
 	}
 
-	res.Headers = make(map[string]string)
-
-	fmt.Println("Request in response is", res.Request)
+	res.prepareHeaders()
+
+	// body_path is the file whose bytes are sent, which is a precompressed
+	// sibling of res.FilePath when the client accepts one
+	body_path := res.FilePath
+	encoding := ""
+	precompressed := false
+	if file_info != nil {
+		siblings := res.findPrecompressed()
+		if sibling := res.selectPrecompressed(siblings); sibling != nil {
+			fmt.Println("Serving precompressed sibling", sibling.path)
+			body_path, file_info, encoding = sibling.path, sibling.info, sibling.encoding
+			precompressed = true
+		}
 
-	res.Headers["Date"] = FormatTime(time.Now())
-	if res.Request != nil {
-		if res.Request.Close {
-			res.Headers["Connection"] = "close"
+		etag, err := fileETag(body_path, file_info, res.fileOptions().ETag)
+		if err != nil {
+			fmt.Println("Error computing ETag", err)
+			res.HandleError(statusInternalServerError)
+			file_info = nil
+		} else {
+			if len(siblings) > 0 || res.compressible(file_info) {
+				res.Headers["Vary"] = "Accept-Encoding"
+			}
+			if !precompressed {
+				encoding = res.selectEncoding(file_info)
+			}
+			if encoding != "" {
+				etag = encodingETag(etag, encoding)
+			}
+			res.Headers["ETag"] = etag
+			res.Headers["Last-Modified"] = FormatTime(file_info.ModTime())
+			res.StatusCode = res.checkPreconditions(file_info, etag)
+			if res.StatusCode == statusOK {
+				res.StatusCode = res.checkRange(file_info, etag)
+			}
+			if res.StatusCode == statusRangeNotSatisfiable {
+				res.Headers["Content-Range"] = "bytes */" + strconv.FormatInt(file_info.Size(), 10)
+			}
 		}
-	} else {
-		fmt.Println("Request in response object is nil!")
 	}
 
-	if res.StatusCode == statusOK {
+	if err := res.writeStatusLine(bw); err != nil {
+		return err
+	}
 
-		file_info, err := os.Stat(res.FilePath)
-		fmt.Println("File path being accessed", res.FilePath)
-		if err != nil {
-			// other error
-			fmt.Println("Error accessing file", err)
-			return err
+	if file_info != nil && (res.StatusCode == statusOK || res.StatusCode == statusPartialContent) {
+
+		content_type := MIMETypeByExtension(path.Ext(res.FilePath))
+		res.Headers["Content-Type"] = content_type
+
+		offset, length := int64(0), file_info.Size()
+		boundary := ""
+		if res.StatusCode == statusPartialContent && len(res.ranges) == 1 {
+			r := res.ranges[0]
+			offset, length = r.start, r.length
+			res.Headers["Content-Range"] = r.contentRange(file_info.Size())
+		} else if res.StatusCode == statusPartialContent {
+			// several ranges go out as one multipart/byteranges body
+			boundary = randomBoundary()
+			length = multipartLength(res.ranges, content_type, file_info.Size(), boundary)
+			res.Headers["Content-Type"] = "multipart/byteranges; boundary=" + boundary
 		}
-		res.Headers["Content-Type"] = MIMETypeByExtension(path.Ext(res.FilePath))
 
-		res.Headers["Last-Modified"] = FormatTime(file_info.ModTime())
-		res.Headers["Content-Length"] = strconv.Itoa((int(file_info.Size())))
+		if encoding == "" || precompressed {
+			// ranges are never served from a body compressed on the fly
+			res.Headers["Accept-Ranges"] = "bytes"
+		}
+		if encoding != "" {
+			res.Headers["Content-Encoding"] = encoding
+		}
+		if encoding != "" && !precompressed {
+			// the compressed length is not known until the whole file is read
+			res.Headers["Transfer-Encoding"] = "chunked"
+		} else {
+			res.Headers["Content-Length"] = strconv.FormatInt(length, 10)
+		}
 
 		// write headers into buffer
 		sortAndWrite(res.Headers, bw)
 
-		_, err = bw.WriteString("\r\n")
+		_, err := bw.WriteString("\r\n")
 		if err != nil {
 			return err
 		}
 
-		fp, err := os.Open(res.FilePath)
-		if err != nil {
-			fmt.Println("Error accessing file in", getCurrentFunctionName(), err)
-		}
-		defer fp.Close()
-		buf := make([]byte, 100)
-		for {
-			blen, err := fp.Read(buf)
-			//fmt.Println("File contents -->", string(buf))
-
-			if err != nil {
-				if err != io.EOF {
-					fmt.Println("Error reading file in ", getCurrentFunctionName(), err)
-					return err
-				}
-				break
+		if res.bodyAllowed() && encoding != "" && !precompressed {
+			if err := writeCompressed(bw, body_path, length, encoding); err != nil {
+				return err
 			}
-
-			_, err = bw.Write(buf[:blen])
-
-			if err != nil {
+		} else if res.bodyAllowed() && boundary != "" {
+			if err := writeRanges(bw, body_path, res.ranges, content_type, file_info.Size(), boundary); err != nil {
+				return err
+			}
+		} else if res.bodyAllowed() {
+			if err := writeFile(bw, body_path, offset, length); err != nil {
 				return err
 			}
-
 		}
 
-	} else if res.StatusCode == statusBadRequest {
+	} else if res.StatusCode == statusBadRequest && res.Request == nil {
 
 		//Not writing any other header only these 2
 
@@ -525,13 +798,22 @@ func (res *Response) Write(w io.Writer) error {
 			return err
 		}
 
-	} else if res.StatusCode == statusFileNotFound {
+	} else {
+		if res.StatusCode != statusNotModified && res.StatusCode != statusNoContent {
+			res.Headers["Content-Length"] = strconv.Itoa(len(res.Body))
+		}
+
 		sortAndWrite(res.Headers, bw)
 		_, err := bw.WriteString("\r\n") // adding one more \r\n in the end
 		if err != nil {
 			return err
 		}
 
+		if res.bodyAllowed() {
+			if _, err := bw.Write(res.Body); err != nil {
+				return err
+			}
+		}
 	}
 
 	if err := bw.Flush(); err != nil {
@@ -541,6 +823,118 @@ func (res *Response) Write(w io.Writer) error {
 	return nil
 }
 
+// prepareHeaders adds the headers every response carries.
+func (res *Response) prepareHeaders() {
+	if res.Headers == nil {
+		res.Headers = make(map[string]string)
+	}
+
+	fmt.Println("Request in response is", res.Request)
+
+	res.Headers["Date"] = FormatTime(time.Now())
+	if res.Request != nil {
+		if res.Request.Close {
+			res.Headers["Connection"] = "close"
+		} else if res.keepAlive != "" {
+			res.Headers["Keep-Alive"] = res.keepAlive
+		}
+	} else {
+		// the request was rejected, so the connection is closed after it
+		fmt.Println("Request in response object is nil!")
+		res.Headers["Connection"] = "close"
+	}
+}
+
+func (res *Response) writeStatusLine(bw *bufio.Writer) error {
+	statusLine := fmt.Sprintf("%v %v %v\r\n", res.Proto, res.StatusCode, reasonPhrase(res.StatusCode))
+	if _, err := bw.WriteString(statusLine); err != nil {
+		fmt.Println("Error in writing status line into connection")
+		return err
+	}
+	return nil
+}
+
+// writeHead writes the status line and the headers of res, followed by
+// the blank line that ends the header section.
+func (res *Response) writeHead(bw *bufio.Writer) error {
+	res.prepareHeaders()
+	if err := res.writeStatusLine(bw); err != nil {
+		return err
+	}
+	if err := sortAndWrite(res.Headers, bw); err != nil {
+		return err
+	}
+	_, err := bw.WriteString("\r\n")
+	return err
+}
+
+// parser returns the Parser to read requests with.
+func (s *Server) parser() *Parser {
+	if s.Parser == nil {
+		return &Parser{}
+	}
+	return s.Parser
+}
+
+// maxBodyBytes returns the request body size limit of s.
+func (s *Server) maxBodyBytes() int64 {
+	if s.MaxBodyBytes <= 0 {
+		return defaultMaxBodyBytes
+	}
+	return s.MaxBodyBytes
+}
+
+// fileOptions returns the options to serve res.FilePath with.
+func (res *Response) fileOptions() *FileOptions {
+	if res.FileOptions == nil {
+		return &FileOptions{}
+	}
+	return res.FileOptions
+}
+
+// bodyAllowed reports whether a message body may follow the headers of res.
+// Responses to HEAD requests carry the same headers as the matching GET
+// response but never a body, and a 204 or 304 never has one either.
+func (res *Response) bodyAllowed() bool {
+	if res.StatusCode == statusNotModified || res.StatusCode == statusNoContent {
+		return false
+	}
+	return res.Request == nil || res.Request.Method != methodHead
+}
+
+// writeFile streams length bytes of the file at filePath, starting at
+// offset, into bw.
+func writeFile(bw io.Writer, filePath string, offset int64, length int64) error {
+	fp, err := os.Open(filePath)
+	if err != nil {
+		fmt.Println("Error accessing file in", getCurrentFunctionName(), err)
+		return err
+	}
+	defer fp.Close()
+	section := io.NewSectionReader(fp, offset, length)
+	buf := make([]byte, 100)
+	for {
+		blen, err := section.Read(buf)
+		//fmt.Println("File contents -->", string(buf))
+
+		if err != nil {
+			if err != io.EOF {
+				fmt.Println("Error reading file in ", getCurrentFunctionName(), err)
+				return err
+			}
+			break
+		}
+
+		_, err = bw.Write(buf[:blen])
+
+		if err != nil {
+			return err
+		}
+
+	}
+	return nil
+}
+
 func getCurrentFunctionName() string {
 	pc, _, _, _ := runtime.Caller(1)
 	funcName := runtime.FuncForPC(pc).Name()
@@ -571,7 +965,7 @@ func ReadLine(br *bufio.Reader) (string, error) {
 	}
 }
 
-func sortAndWrite(slice map[string]string, bw *bufio.Writer) (err error) {
+func sortAndWrite(slice map[string]string, bw io.Writer) (err error) {
 	var keys []string
 	for key := range slice {
 		keys = append(keys, key)
@@ -584,7 +978,7 @@ func sortAndWrite(slice map[string]string, bw *bufio.Writer) (err error) {
 
 	// print the sorted map
 	for _, key := range keys {
-		_, err := bw.WriteString(key + ": " + slice[key] + "\r\n")
+		_, err := io.WriteString(bw, key+": "+slice[key]+"\r\n")
 		if err != nil {
 			return err
 		}
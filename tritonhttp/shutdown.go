@@ -0,0 +1,148 @@
+package tritonhttp
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// shutdownPollInterval is how often Shutdown looks for connections that
+// have gone idle since it last closed the idle ones.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// connState tells whether a connection is waiting for its first request,
+// waiting for its next request or serving one.
+type connState int
+
+const (
+	connNew connState = iota
+	connIdle
+	connActive
+)
+
+// Shutdown gracefully shuts the server down. It closes the listener, then
+// closes connections as soon as they are idle: requests being served when
+// Shutdown is called are answered first, with "Connection: close". A
+// connection that has not sent its first request yet may be about to, so
+// it is not idle; it is served one request, or closed by its idle timeout.
+// If ctx ends before every connection is closed, Shutdown returns its
+// error and leaves the remaining connections alone; call Close to drop
+// them. ListenAndServe and Serve return ErrServerClosed once Shutdown has
+// been called.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.inShutdown.Store(true)
+	err := s.closeListenersLocked()
+	s.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close immediately closes the listener and every connection, cutting
+// off responses being written. Use Shutdown to let them finish.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inShutdown.Store(true)
+	err := s.closeListenersLocked()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+	return err
+}
+
+// shuttingDown reports whether Shutdown or Close has been called.
+func (s *Server) shuttingDown() bool {
+	return s.inShutdown.Load()
+}
+
+// trackListener registers l to be closed by Shutdown and Close. It
+// returns false, and leaves l alone, if the server is shutting down.
+func (s *Server) trackListener(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown() {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	s.listenerAddr = l.Addr()
+	return true
+}
+
+func (s *Server) forgetListener(l net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, l)
+}
+
+func (s *Server) closeListenersLocked() error {
+	var err error
+	for l := range s.listeners {
+		if close_err := l.Close(); close_err != nil && err == nil {
+			err = close_err
+		}
+		delete(s.listeners, l)
+	}
+	return err
+}
+
+// trackConn registers conn, just accepted, to be closed by Shutdown and
+// Close. It returns false, and leaves conn alone, if the server is
+// shutting down, since Close may have closed the others already.
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown() {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]connState)
+	}
+	s.conns[conn] = connNew
+	return true
+}
+
+// setConnState records the state of conn. A connection that Shutdown or
+// Close has closed and forgotten stays forgotten.
+func (s *Server) setConnState(conn net.Conn, state connState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.conns[conn]; ok {
+		s.conns[conn] = state
+	}
+}
+
+func (s *Server) forgetConn(conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, conn)
+}
+
+// closeIdleConns closes the idle connections and reports whether no
+// connection is left.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, state := range s.conns {
+		if state == connIdle {
+			conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+	return len(s.conns) == 0
+}
@@ -0,0 +1,81 @@
+package tritonhttp
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// SymlinkPolicy selects which symbolic links below a doc root are
+// followed when serving files.
+type SymlinkPolicy string
+
+const (
+	// SymlinksInsideDocRoot follows links whose target, once every link
+	// on the way is resolved, still lies within the doc root. It is the
+	// default.
+	SymlinksInsideDocRoot SymlinkPolicy = "docroot"
+	// SymlinksFollow follows every link, wherever it points.
+	SymlinksFollow SymlinkPolicy = "follow"
+	// SymlinksNever refuses any path that passes through a link below
+	// the doc root. The doc root itself may still be a link.
+	SymlinksNever SymlinkPolicy = "never"
+)
+
+// valid reports whether p is one of the policies above or empty.
+func (p SymlinkPolicy) valid() bool {
+	switch p {
+	case "", SymlinksInsideDocRoot, SymlinksFollow, SymlinksNever:
+		return true
+	}
+	return false
+}
+
+// resolvePath checks that file_path, an absolute path, may be served out
+// of doc_root under policy and returns the path to open: the real path,
+// with every link resolved, unless policy is SymlinksFollow. file_path
+// may be given relative to either doc_root or its real path. ok is false
+// when file_path is outside the doc root, breaks the policy or does not
+// exist, in which case file_path is returned unchanged.
+func resolvePath(doc_root string, file_path string, policy SymlinkPolicy) (resolved string, ok bool) {
+	root, err := filepath.Abs(doc_root)
+	if err != nil {
+		fmt.Println("Error getting absolute path", err)
+		return file_path, false
+	}
+	real_root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		fmt.Println("Error resolving doc root", err)
+		return file_path, false
+	}
+	if !isWithinDir(root, file_path) {
+		if !isWithinDir(real_root, file_path) {
+			fmt.Println("Referencing out of root directory", file_path)
+			return file_path, false
+		}
+		// file_path was resolved already, e.g. it is next to a served file
+		root = real_root
+	}
+	if policy == SymlinksFollow {
+		return file_path, true
+	}
+
+	real_path, err := filepath.EvalSymlinks(file_path)
+	if err != nil {
+		fmt.Println("Error resolving", file_path, err)
+		return file_path, false
+	}
+	if policy == SymlinksNever {
+		// without links on the way the real path is the one asked for
+		rel, err := filepath.Rel(root, file_path)
+		if err != nil || real_path != filepath.Join(real_root, rel) {
+			fmt.Println("Refusing symbolic link in", file_path)
+			return file_path, false
+		}
+		return real_path, true
+	}
+	if !isWithinDir(real_root, real_path) {
+		fmt.Println("Symbolic link in", file_path, "leaves the doc root for", real_path)
+		return file_path, false
+	}
+	return real_path, true
+}
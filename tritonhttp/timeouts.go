@@ -0,0 +1,106 @@
+package tritonhttp
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Timeouts used when the matching Server field is 0.
+const (
+	defaultReadHeaderTimeout = 5 * time.Second
+	defaultIdleTimeout       = 5 * time.Second
+)
+
+// connTimeouts are the timeouts and keep-alive limit applied to the
+// requests of a connection.
+type connTimeouts struct {
+	readHeader  time.Duration
+	read        time.Duration
+	write       time.Duration
+	idle        time.Duration
+	maxRequests int
+}
+
+// timeouts returns the timeouts of s with the overrides of vhost, which
+// may be nil, applied.
+func (s *Server) timeouts(vhost *VirtualHost) connTimeouts {
+	t := connTimeouts{
+		readHeader:  s.ReadHeaderTimeout,
+		read:        s.ReadTimeout,
+		write:       s.WriteTimeout,
+		idle:        s.IdleTimeout,
+		maxRequests: s.MaxRequestsPerConn,
+	}
+	if vhost != nil {
+		if vhost.ReadHeaderTimeout > 0 {
+			t.readHeader = vhost.ReadHeaderTimeout
+		}
+		if vhost.ReadTimeout > 0 {
+			t.read = vhost.ReadTimeout
+		}
+		if vhost.WriteTimeout > 0 {
+			t.write = vhost.WriteTimeout
+		}
+		if vhost.IdleTimeout > 0 {
+			t.idle = vhost.IdleTimeout
+		}
+		if vhost.MaxRequestsPerConn > 0 {
+			t.maxRequests = vhost.MaxRequestsPerConn
+		}
+	}
+	if t.readHeader <= 0 {
+		t.readHeader = defaultReadHeaderTimeout
+	}
+	if t.idle <= 0 {
+		t.idle = defaultIdleTimeout
+	}
+	return t
+}
+
+// lastRequest reports whether the count-th request of a connection is the
+// last one it may serve.
+func (t connTimeouts) lastRequest(count int) bool {
+	return t.maxRequests > 0 && count >= t.maxRequests
+}
+
+// keepAlive returns the Keep-Alive header advertising how long the
+// connection waits for the request after the count-th one, and how many
+// more it serves. The timeout is rounded up to whole seconds, since
+// "timeout=0" would tell clients not to reuse the connection at all.
+func (t connTimeouts) keepAlive(count int) string {
+	value := fmt.Sprintf("timeout=%d", int((t.idle+time.Second-1)/time.Second))
+	if t.maxRequests > 0 {
+		value += fmt.Sprintf(", max=%d", t.maxRequests-count)
+	}
+	return value
+}
+
+// setReadTimeout sets the read deadline of conn to timeout from now, or
+// clears it if timeout is 0.
+func setReadTimeout(conn net.Conn, timeout time.Duration) error {
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	return conn.SetReadDeadline(deadline)
+}
+
+// setRequestDeadlines applies the read and write timeouts to the rest of
+// the request being served on conn, once its head has been read. Without
+// a read timeout the deadline set for the head still applies, so that a
+// body that never arrives cannot hold the connection open.
+func setRequestDeadlines(conn net.Conn, t connTimeouts) {
+	var write_deadline time.Time
+	if t.write > 0 {
+		write_deadline = time.Now().Add(t.write)
+	}
+	if err := conn.SetWriteDeadline(write_deadline); err != nil {
+		fmt.Println("Failed to set write timeout for connection", conn)
+	}
+	if t.read > 0 {
+		if err := setReadTimeout(conn, t.read); err != nil {
+			fmt.Println("Failed to set read timeout for connection", conn)
+		}
+	}
+}
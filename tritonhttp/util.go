@@ -27,6 +27,28 @@ func FormatTime(t time.Time) string {
 	return s
 }
 
+// timeFormats lists the date formats an HTTP/1.1 recipient must accept,
+// most preferred first: IMF-fixdate, the obsolete RFC 850 format and the
+// ANSI C asctime() format.
+var timeFormats = []string{
+	"Mon, 02 Jan 2006 15:04:05 GMT",
+	time.RFC850,
+	time.ANSIC,
+}
+
+// ParseTime parses a date from an HTTP header such as "If-Modified-Since".
+// It accepts all three formats allowed by the HTTP spec and returns the
+// error of the last attempt when none of them match.
+func ParseTime(text string) (t time.Time, err error) {
+	for _, layout := range timeFormats {
+		t, err = time.Parse(layout, text)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return t, err
+}
+
 // MIMETypeByExtension returns the MIME type associated with the
 // file extension ext. The extension ext should begin with a
 // leading dot, as in ".html". When ext has no associated type,
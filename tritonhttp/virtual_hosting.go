@@ -1,42 +1,136 @@
 package tritonhttp
 
 import (
-	"io/ioutil"
 	"log"
-	"os"
-	"path/filepath"
-
-	"gopkg.in/yaml.v2"
+	"strings"
+	"time"
 )
 
-type VHConfigs struct {
-	VirtualHosts []struct {
-		HostName string `yaml:"hostName"`
-		DocRoot  string `yaml:"docRoot"`
-	} `yaml:"virtual_hosts"`
-}
+// defaultHostName is the key of the virtual host that serves requests
+// whose Host matches no other one.
+const defaultHostName = "*"
 
-func ParseVHConfigFile(vhConfigFilePath string, docroot_dirs_path string) map[string]string {
-	vh_map := make(map[string]string)
-	f, err := ioutil.ReadFile(vhConfigFilePath)
+// defaultIndexFiles are the files looked for in a requested directory
+// when VirtualHost.IndexFiles is empty.
+var defaultIndexFiles = []string{"index.html"}
 
-	if err != nil {
-		log.Fatalf("could not read config file %s : %v", vhConfigFilePath, err)
-	}
+// VirtualHost is the configuration of one site served by a Server. Every
+// field but HostName and DocRoot is optional; the zero value of each
+// keeps the behavior of a host configured with just those two.
+type VirtualHost struct {
+	// HostName is the host name served, a leading wildcard such as
+	// "*.website1", which matches every subdomain of website1, or "*".
+	HostName string `yaml:"hostName"`
+
+	// DocRoot is the directory static files are served from. In the
+	// config file it is relative to the docroot directory.
+	DocRoot string `yaml:"docRoot"`
+
+	// IndexFiles are tried in order for requests of a directory.
+	// Empty means defaultIndexFiles.
+	IndexFiles []string `yaml:"indexFiles"`
+
+	// Aliases are further host names served by this host. They may be
+	// wildcards like HostName.
+	Aliases []string `yaml:"aliases"`
+
+	// Default makes this host serve requests for unknown hosts, as if
+	// it had the alias "*".
+	Default bool `yaml:"default"`
+
+	// Headers are added to every response of this host.
+	Headers map[string]string `yaml:"headers"`
+
+	// ErrorPages maps a status code to the file, relative to DocRoot,
+	// sent as the body of error responses with that status.
+	ErrorPages map[int]string `yaml:"errorPages"`
+
+	// ReadHeaderTimeout, ReadTimeout, WriteTimeout, IdleTimeout and
+	// MaxRequestsPerConn override the Server fields of the same name for
+	// requests of this host. 0 means the server's value. The host is only
+	// known once a request head is read, so ReadHeaderTimeout and
+	// IdleTimeout apply to the requests after one of this host on a
+	// connection.
+	ReadHeaderTimeout  time.Duration `yaml:"readHeaderTimeout"`
+	ReadTimeout        time.Duration `yaml:"readTimeout"`
+	WriteTimeout       time.Duration `yaml:"writeTimeout"`
+	IdleTimeout        time.Duration `yaml:"idleTimeout"`
+	MaxRequestsPerConn int           `yaml:"maxRequestsPerConn"`
+
+	// AutoIndex answers requests of a directory without an index file
+	// with a generated listing instead of a 404.
+	AutoIndex bool `yaml:"autoIndex"`
+
+	// DisableCompression and DisablePrecompressed turn off the
+	// FileOptions of the same name for this host.
+	DisableCompression   bool `yaml:"disableCompression"`
+	DisablePrecompressed bool `yaml:"disablePrecompressed"`
+
+	// StrongETags makes this host send ETagStrong entity tags.
+	StrongETags bool `yaml:"strongETags"`
 
-	vhostConfigs := VHConfigs{}
-	err = yaml.Unmarshal(f, &vhostConfigs)
+	// Symlinks is the policy for symbolic links below DocRoot:
+	// "docroot", the default, "follow" or "never".
+	Symlinks SymlinkPolicy `yaml:"symlinks"`
 
-	for _, vhost := range vhostConfigs.VirtualHosts {
-		docroot_path := filepath.Join(docroot_dirs_path, vhost.DocRoot)
+	// Rules are the redirect and rewrite rules of the host, read from
+	// its "redirects" and "rewrites" keys.
+	Rules `yaml:",inline"`
+}
+
+// indexFiles returns the index files to look for in directories.
+func (vh *VirtualHost) indexFiles() []string {
+	if len(vh.IndexFiles) == 0 {
+		return defaultIndexFiles
+	}
+	return vh.IndexFiles
+}
 
-		// Check if the path exists
-		_, err := os.Stat(docroot_path)
-		if err != nil {
-			log.Fatalf("path to docroot %s doesn't exist : %v", docroot_path, err)
+// fileOptions returns opts with the feature toggles of vh applied.
+func (vh *VirtualHost) fileOptions(opts FileOptions) *FileOptions {
+	opts.DisableCompression = opts.DisableCompression || vh.DisableCompression
+	opts.DisablePrecompressed = opts.DisablePrecompressed || vh.DisablePrecompressed
+	if vh.StrongETags {
+		opts.ETag = ETagStrong
+	}
+	opts.docRoot = vh.DocRoot
+	opts.symlinks = vh.Symlinks
+	return &opts
+}
+
+// lookupVirtualHost returns the virtual host in vh_map serving host, or
+// nil if there is none. An exact name or alias wins over a wildcard, a
+// wildcard over the default host, and a longer wildcard over a shorter one:
+// "a.b.website1" is served by "*.b.website1" rather than "*.website1".
+func lookupVirtualHost(vh_map map[string]*VirtualHost, host string) *VirtualHost {
+	if vhost, ok := vh_map[host]; ok {
+		return vhost
+	}
+	for domain := host; ; {
+		_, parent, found := strings.Cut(domain, ".")
+		if !found || parent == "" {
+			break
 		}
-		vh_map[vhost.HostName] = docroot_path
+		if vhost, ok := vh_map["*."+parent]; ok {
+			return vhost
+		}
+		domain = parent
 	}
+	return vh_map[defaultHostName]
+}
 
+type VHConfigs struct {
+	VirtualHosts []VirtualHost `yaml:"virtual_hosts"`
+}
+
+// ParseVHConfigFile reads the virtual hosts in the config file like
+// LoadConfig, but exits the program if the config has any problem.
+//
+// Deprecated: use LoadConfig, which returns the problems instead.
+func ParseVHConfigFile(vhConfigFilePath string, docroot_dirs_path string) map[string]*VirtualHost {
+	vh_map, err := LoadConfig(vhConfigFilePath, docroot_dirs_path)
+	if err != nil {
+		log.Fatal(err)
+	}
 	return vh_map
 }